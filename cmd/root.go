@@ -19,8 +19,10 @@ import (
 	"context"
 	"fmt"
 	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"sigs.k8s.io/yaml"
 
 	doorman "github.com/meln5674/doorman/internal"
@@ -31,24 +33,12 @@ var (
 	cfgFile string
 )
 
-// TODO: make a "validate" command which validates a config file (and optionally testing connection to k8s) without changing any files or restarting nginx
-
 var rootCmd = &cobra.Command{
 	Use:   "doorman",
 	Short: "Kubenetes Load Balancer Automation",
 	Long:  `Doorman makes it simple to automatically create and update a Load Balancing server whenever nodes change`,
 	Run: func(cmd *cobra.Command, args []string) {
-		var cfg public.ConfigFile
-
-		cfgBytes, err := ioutil.ReadFile(cfgFile)
-		if err != nil {
-			fmt.Printf("Failed to read config file: %v\n", err)
-			os.Exit(1)
-		}
-		if err := yaml.Unmarshal(cfgBytes, &cfg); err != nil {
-			fmt.Printf("Failed to unmarshal config file: %v\n", err)
-			os.Exit(1)
-		}
+		cfg, cfgBytes := loadConfig()
 
 		// TODO: Handle SIGINT as graceful shutdown
 		// TODO: Handle SIGHUP as config reload
@@ -56,13 +46,22 @@ var rootCmd = &cobra.Command{
 		ctx := context.Background()
 		stop := make(chan struct{})
 		app := doorman.Doorman{}
+		fmt.Printf("Starting doorman %s\n", doorman.Version)
 		fmt.Println(cfg)
 		fmt.Println("Loading config...")
-		if err := app.FromConfig(&cfg); err != nil {
+		if err := app.FromConfig(cfg); err != nil {
 			fmt.Printf("Failed to parse config file: %v\n", err)
 			os.Exit(1)
 		}
+		app.SetConfigFile(cfgFile, cfgBytes)
 		fmt.Println(app)
+		overrides := make(chan os.Signal, 1)
+		signal.Notify(overrides, unix.SIGUSR1)
+		go func() {
+			for range overrides {
+				app.OverrideGuards()
+			}
+		}()
 		fmt.Println("Running...")
 		if err := app.Run(ctx, stop); err != nil {
 			fmt.Printf("Stopping with error: %v\n", err)
@@ -71,6 +70,22 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// loadConfig reads and unmarshals the config file, exiting if it cannot, and returns it along with its contents
+func loadConfig() (*public.ConfigFile, []byte) {
+	var cfg public.ConfigFile
+
+	cfgBytes, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		fmt.Printf("Failed to read config file: %v\n", err)
+		os.Exit(1)
+	}
+	if err := yaml.Unmarshal(cfgBytes, &cfg); err != nil {
+		fmt.Printf("Failed to unmarshal config file: %v\n", err)
+		os.Exit(1)
+	}
+	return &cfg, cfgBytes
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
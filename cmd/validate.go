@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+
+	doorman "github.com/meln5674/doorman/internal"
+)
+
+// TODO: Optionally test the connection to k8s
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate a config file",
+	Long:  `Parses and validates a config file without changing any files or restarting nginx`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, _ := loadConfig()
+		app := doorman.Doorman{}
+		if err := app.FromConfig(cfg); err != nil {
+			fmt.Printf("Invalid config file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Config file is valid")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
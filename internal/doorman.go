@@ -3,10 +3,15 @@ package internal
 import (
 	"context"
 	"fmt"
-	"k8s.io/apimachinery/pkg/watch"
-	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	"net"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	k8sconfig "k8s.io/client-go/tools/clientcmd"
@@ -21,20 +26,33 @@ import (
 var TemplateFactories map[string]TemplateFactory = make(map[string]TemplateFactory)
 
 type TemplateFactory interface {
-	Parse(template string, path string) (Templater, error)
+	// Parse parses a template for a file, along with partials which it may use, by name
+	Parse(template string, partials map[string]string, path string) (Templater, error)
 }
 
 // Doorman is the data parsed from a ConfigFile
 type Doorman struct {
-	kubernetesAPIs []corev1.NodeInterface
+	kubernetesAPIs []kubernetes.Interface
 	nodePools      []NodePoolDescription
-	templates      []Templater
+	endpointPools  []EndpointPoolDescription
+	loadBalancer   *LoadBalancerDescription
+	ingresses      *IngressesDescription
+	tlsSecrets     []TLSSecretDescription
+	templates      []ManagedFile
 	actions        []Action
 	health         *HealthEndpoint
 	metrics        *MetricsEndpoint
-}
-
-type HealthEndpoint struct {
+	// overrides receives operator overrides of tripped guards
+	overrides chan struct{}
+	stateFile string
+	// resyncInterval is how often to restart all watches and render from scratch, zero if never
+	resyncInterval time.Duration
+	// meta is the metadata of the last generation
+	meta MetaVars
+	// generated is the state of the last generation, nil if there has not been one
+	generated *TemplateVars
+	// fallbacks maps each user of a fallback pool, i.e. a port or the HTTP hosts of a pool, to the fallback pool it uses
+	fallbacks map[string]string
 }
 
 type MetricsEndpoint struct {
@@ -51,13 +69,13 @@ func (d *Doorman) FromConfig(cfg *public.ConfigFile) error {
 		}
 		var contextFilter map[string]struct{}
 		if len(cfg.Kubernetes.Contexts) == 0 {
-			d.kubernetesAPIs = make([]corev1.NodeInterface, 0, len(allConfigs.Contexts))
+			d.kubernetesAPIs = make([]kubernetes.Interface, 0, len(allConfigs.Contexts))
 			contextFilter = make(map[string]struct{}, len(allConfigs.Contexts))
 			for contextName, _ := range allConfigs.Contexts {
 				contextFilter[contextName] = struct{}{}
 			}
 		} else {
-			d.kubernetesAPIs = make([]corev1.NodeInterface, 0, len(cfg.Kubernetes.Contexts))
+			d.kubernetesAPIs = make([]kubernetes.Interface, 0, len(cfg.Kubernetes.Contexts))
 			contextFilter = make(map[string]struct{}, 0)
 		}
 		for contextName, context := range allConfigs.Contexts {
@@ -74,7 +92,8 @@ func (d *Doorman) FromConfig(cfg *public.ConfigFile) error {
 			if err != nil {
 				return err
 			}
-			d.kubernetesAPIs = append(d.kubernetesAPIs, client.CoreV1().Nodes())
+			d.kubernetesAPIs = append(d.kubernetesAPIs, client)
+			d.addKubernetes(contextName, context.Cluster, config.Host)
 		}
 		// TODO: validate no contexts are present multiple times
 	} else {
@@ -91,35 +110,129 @@ func (d *Doorman) FromConfig(cfg *public.ConfigFile) error {
 			return err
 		}
 
-		d.kubernetesAPIs = make([]corev1.NodeInterface, 1)
+		d.kubernetesAPIs = make([]kubernetes.Interface, 1)
 		client, err := kubernetes.NewForConfig(config)
 		if err != nil {
 			return err
 		}
-		d.kubernetesAPIs[0] = client.CoreV1().Nodes()
+		d.kubernetesAPIs[0] = client
+		contextName, cluster := "", ""
+		if raw, err := k8sconfig.LoadFromFile(kubeconfigPath); err == nil {
+			contextName = raw.CurrentContext
+			if context, ok := raw.Contexts[contextName]; ok {
+				cluster = context.Cluster
+			}
+		}
+		d.addKubernetes(contextName, cluster, config.Host)
 	}
 
-	d.nodePools = make([]NodePoolDescription, len(cfg.NodePools))
-	for i, pool := range cfg.NodePools {
-		d.nodePools[i].FromConfig(&pool)
+	nodePools := cfg.NodePools
+	if nodePools != nil && cfg.NodePoolsPreset != "" {
+		return fmt.Errorf("Only one of nodePools and nodePoolsPreset may be set")
 	}
-
-	d.templates = make([]Templater, 0, len(cfg.Templates))
-	for _, template := range cfg.Templates {
-		factory, ok := TemplateFactories[template.Engine]
-		if !ok {
-			return fmt.Errorf("Unrecognized template engine: %s", template.Engine)
+	// The default pools are only used if no pools are configured at all, but a preset may be selected along with endpoint pools
+	if nodePools == nil && (cfg.EndpointPools == nil || cfg.NodePoolsPreset != "") {
+		preset := cfg.NodePoolsPreset
+		if preset == "" {
+			preset = DefaultNodePoolsPreset
 		}
-		tpl, err := factory.Parse(template.Template, template.Path)
+		var err error
+		nodePools, err = NodePoolsPreset(preset)
 		if err != nil {
 			return err
 		}
-		d.templates = append(d.templates, tpl)
+		fmt.Printf("Using node pools preset %s\n", preset)
+	}
+	d.nodePools = make([]NodePoolDescription, len(nodePools))
+	for i, pool := range nodePools {
+		if err := d.nodePools[i].FromConfig(&pool); err != nil {
+			return fmt.Errorf("Invalid node pool %s: %v", pool.Name, err)
+		}
+	}
+	d.endpointPools = make([]EndpointPoolDescription, len(cfg.EndpointPools))
+	for i, pool := range cfg.EndpointPools {
+		if err := d.endpointPools[i].FromConfig(&pool); err != nil {
+			return fmt.Errorf("Invalid endpoint pool %s: %v", pool.Name, err)
+		}
+	}
+	names := make(map[string]struct{}, len(d.nodePools)+len(d.endpointPools))
+	for _, pool := range d.nodePools {
+		names[pool.name] = struct{}{}
+	}
+	for _, pool := range d.nodePools {
+		for _, fallback := range pool.fallbackPools {
+			// Endpoint pools are not allowed, as their ports are not the same as those of nodes
+			if d.nodePool(fallback) == nil {
+				return fmt.Errorf("Invalid node pool %s: No such fallback node pool %s", pool.name, fallback)
+			}
+		}
+	}
+	for _, pool := range d.endpointPools {
+		if _, ok := names[pool.name]; ok {
+			return fmt.Errorf("Invalid endpoint pool %s: A pool with that name already exists", pool.name)
+		}
+		names[pool.name] = struct{}{}
+	}
+	if err := validateListeners(d.nodePools, d.endpointPools); err != nil {
+		return err
+	}
+
+	if cfg.LoadBalancer != nil {
+		d.loadBalancer = &LoadBalancerDescription{}
+		if err := d.loadBalancer.FromConfig(cfg.LoadBalancer); err != nil {
+			return fmt.Errorf("Invalid load balancer: %v", err)
+		}
+		if d.nodePool(d.loadBalancer.nodePool) == nil {
+			return fmt.Errorf("Invalid load balancer: No such node pool %s", d.loadBalancer.nodePool)
+		}
+	}
+
+	if cfg.Ingresses != nil {
+		d.ingresses = &IngressesDescription{}
+		if err := d.ingresses.FromConfig(cfg.Ingresses); err != nil {
+			return fmt.Errorf("Invalid ingresses: %v", err)
+		}
+		if _, ok := names[d.ingresses.pool]; !ok {
+			return fmt.Errorf("Invalid ingresses: No such pool %s", d.ingresses.pool)
+		}
+	}
+
+	d.tlsSecrets = make([]TLSSecretDescription, len(cfg.TLSSecrets))
+	for i, secret := range cfg.TLSSecrets {
+		if err := d.tlsSecrets[i].FromConfig(&secret); err != nil {
+			return fmt.Errorf("Invalid TLS secret %d: %v", i, err)
+		}
+	}
+
+	templates := cfg.Templates
+	if templates == nil {
+		fmt.Printf("Using template preset %s\n", DefaultTemplatePreset)
+		templates = []public.Template{{Preset: DefaultTemplatePreset}}
+	}
+	env, err := allowedEnv(cfg.Env)
+	if err != nil {
+		return err
+	}
+	d.templates = make([]ManagedFile, len(templates))
+	for i, template := range templates {
+		if err := d.templates[i].FromConfig(&template); err != nil {
+			return err
+		}
+		d.templates[i].vars = mergeVars(cfg.Vars, template.Vars)
+		d.templates[i].env = env
+	}
+	if err := d.validatePresets(); err != nil {
+		return err
 	}
 	d.actions = make([]Action, 1)
 	d.actions[0] = &BlindNginxRestartAction{}
+	d.overrides = make(chan struct{}, 1)
+	d.stateFile = cfg.StateFile
+	if cfg.ResyncInterval != nil {
+		d.resyncInterval = cfg.ResyncInterval.Duration
+	}
 	if cfg.Health != nil {
-		// TODO: set up http health endpoint handler
+		d.health = &HealthEndpoint{port: cfg.Health.Port}
 	}
 	if cfg.Metrics != nil {
 		// TODO: set up prometheus metrics
@@ -128,139 +241,694 @@ func (d *Doorman) FromConfig(cfg *public.ConfigFile) error {
 	return nil
 }
 
+// validatePresets checks the parameters of each preset template, and that it supports the algorithm of every port
+func (d *Doorman) validatePresets() error {
+	algorithms := make(map[string]struct{})
+	hasListenAddress := d.loadBalancer != nil
+	addOptions := func(options PortOptions, address string) {
+		if options.Algorithm != "" {
+			algorithms[options.Algorithm] = struct{}{}
+		}
+		if address != "" {
+			hasListenAddress = true
+		}
+	}
+	for _, pool := range d.nodePools {
+		for _, port := range pool.ports {
+			addOptions(port.PortOptions, port.Address)
+		}
+		if pool.nodePortServices != nil {
+			addOptions(pool.nodePortServices.options, pool.nodePortServices.listenAddress)
+		}
+	}
+	for _, pool := range d.endpointPools {
+		for _, port := range pool.ports {
+			addOptions(port.PortOptions, port.Address)
+		}
+	}
+	if d.loadBalancer != nil {
+		addOptions(d.loadBalancer.options, "")
+	}
+	names := make([]string, 0, len(algorithms))
+	for algorithm := range algorithms {
+		names = append(names, algorithm)
+	}
+	sort.Strings(names)
+	for _, file := range d.templates {
+		if file.preset == nil {
+			continue
+		}
+		if file.preset.Validate != nil {
+			if err := file.preset.Validate(file.params, hasListenAddress); err != nil {
+				return fmt.Errorf("Invalid template %s: %v", file.path, err)
+			}
+		}
+		if file.preset.Backend == "" {
+			continue
+		}
+		for _, algorithm := range append([]string{file.params["algorithm"]}, names...) {
+			if _, err := lbAlgorithm(file.preset.Backend, algorithm); err != nil {
+				return fmt.Errorf("Invalid template %s: %v", file.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// nodePool returns the node pool with a name, or nil if there is none
+func (d *Doorman) nodePool(name string) *NodePoolDescription {
+	for i := range d.nodePools {
+		if d.nodePools[i].name == name {
+			return &d.nodePools[i]
+		}
+	}
+	return nil
+}
+
+// OverrideGuards renders the current state even if it exceeds the limits of a pool's guard
+func (d *Doorman) OverrideGuards() {
+	select {
+	case d.overrides <- struct{}{}:
+	default:
+		// An override is already pending
+	}
+}
+
+// guards returns the guard of each pool which has one
+func (d *Doorman) guards() map[string]GuardDescription {
+	guards := make(map[string]GuardDescription)
+	for _, pool := range d.nodePools {
+		if pool.guard != nil {
+			guards[pool.name] = *pool.guard
+		}
+	}
+	for _, pool := range d.endpointPools {
+		if pool.guard != nil {
+			guards[pool.name] = *pool.guard
+		}
+	}
+	return guards
+}
+
+// endpointSliceNamespaces returns the namespaces which endpoint slices must be watched in to find the nodes for services with local traffic,
+// which is a single empty namespace if all namespaces must be watched
+func (d *Doorman) endpointSliceNamespaces() []string {
+	namespaces := make(map[string]struct{})
+	for _, pool := range d.nodePools {
+		for _, port := range pool.ports {
+			if port.LocalService != "" {
+				namespaces[strings.SplitN(port.LocalService, "/", 2)[0]] = struct{}{}
+			}
+		}
+		if pool.nodePortServices != nil {
+			namespaces[pool.nodePortServices.namespace] = struct{}{}
+		}
+	}
+	if d.loadBalancer != nil {
+		namespaces[d.loadBalancer.namespace] = struct{}{}
+	}
+	if _, ok := namespaces[""]; ok {
+		return []string{""}
+	}
+	list := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		list = append(list, namespace)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// validateListeners checks that no two port mappings, in the same pool or different pools, would listen on the same address, protocol, and port
+func validateListeners(pools []NodePoolDescription, endpointPools []EndpointPoolDescription) error {
+	owners := make(map[Listener]string)
+	check := func(pool string, listener Listener) error {
+		key := listener.normalized()
+		if owner, ok := owners[key]; ok {
+			return fmt.Errorf("Listener %s in pool %s conflicts with pool %s", listener, pool, owner)
+		}
+		owners[key] = pool
+		return nil
+	}
+	for _, pool := range pools {
+		for _, port := range pool.ports {
+			if err := check(pool.name, port.Listener()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pool := range endpointPools {
+		for _, port := range pool.ports {
+			if err := check(pool.name, port.Listener()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type portPool struct {
-	addresses map[string]struct{}
-	destPort  int
+	// pool is the name of the pool the port is from
+	pool string
+	// addresses maps each address to its zone
+	addresses map[string]string
+	// backupAddresses maps each address from fallback pools to use as a backup to its zone
+	backupAddresses map[string]string
+	destPort        int
+	sourceRange     public.PortRange
+	options         PortOptions
+	preferredZone   string
 }
 
-type portPools map[int]portPool
+type portPools map[Listener]portPool
 
-func (p portPools) init(port PortMapping) {
-	p[port.Source] = portPool{addresses: make(map[string]struct{}), destPort: port.Dest}
+func (p portPools) init(pool string, port PortMapping, addresses, backupAddresses map[string]string, preferredZone string) {
+	p[port.Listener()] = portPool{pool: pool, addresses: addresses, backupAddresses: backupAddresses, destPort: port.Dest, sourceRange: port.Range, options: port.PortOptions, preferredZone: preferredZone}
 }
 
-func (p portPools) add(port int, address string) (added bool) {
-	_, ok := p[port].addresses[address]
-	added = !ok
-	p[port].addresses[address] = struct{}{}
-	return
+// sortedAddresses returns the keys of a set of addresses, sorted
+func sortedAddresses(addresses map[string]string) []string {
+	list := make([]string, 0, len(addresses))
+	for address := range addresses {
+		list = append(list, address)
+	}
+	sort.Strings(list)
+	return list
 }
 
-func (p portPools) remove(port int, address string) (removed bool) {
-	_, ok := p[port].addresses[address]
-	removed = ok
-	delete(p[port].addresses, address)
-	return
+// zoneVars groups addresses by zone, sorted by zone
+func zoneVars(addresses map[string]string) []ZoneVars {
+	byZone := make(map[string]map[string]string)
+	for address, zone := range addresses {
+		if _, ok := byZone[zone]; !ok {
+			byZone[zone] = make(map[string]string)
+		}
+		byZone[zone][address] = zone
+	}
+	zones := make([]ZoneVars, 0, len(byZone))
+	for zone, zoneAddresses := range byZone {
+		zones = append(zones, ZoneVars{Zone: zone, Addresses: sortedAddresses(zoneAddresses)})
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].Zone < zones[j].Zone
+	})
+	return zones
+}
+
+// appendFallbacks adds addresses from fallback pools to a list of backup addresses, except for those which are already used
+func appendFallbacks(backupAddresses []string, addresses, fallbackAddresses map[string]string) []string {
+	for _, address := range sortedAddresses(fallbackAddresses) {
+		if _, ok := addresses[address]; !ok {
+			backupAddresses = append(backupAddresses, address)
+		}
+	}
+	return backupAddresses
 }
 
-func (p portPools) render() []PortVars {
+// splitByZone returns the addresses in a preferred zone, and the addresses in other zones as backups.
+// If there is no preferred zone, or no addresses in it, all addresses are used with no backups.
+func splitByZone(addresses map[string]string, preferredZone string) ([]string, []string) {
+	if preferredZone == "" {
+		return sortedAddresses(addresses), nil
+	}
+	local := make(map[string]string)
+	others := make(map[string]string)
+	for address, zone := range addresses {
+		if zone == preferredZone {
+			local[address] = zone
+		} else {
+			others[address] = zone
+		}
+	}
+	if len(local) == 0 {
+		return sortedAddresses(others), nil
+	}
+	return sortedAddresses(local), sortedAddresses(others)
+}
+
+// render produces the template variables for each listener of the given protocol, sorted by port, then address, so that output is stable.
+// Listeners which were expanded from a range are collapsed back into a single entry for the range.
+func (p portPools) render(protocol corev1.Protocol) []PortVars {
 	ports := make([]PortVars, 0, len(p))
-	for port, pool := range p {
-		addressList := make([]string, 0, len(pool.addresses))
-		for address, _ := range pool.addresses {
-			addressList = append(addressList, address)
+	for listener, pool := range p {
+		if listener.Protocol != protocol {
+			continue
+		}
+		if listener.Port != pool.sourceRange.First {
+			// Rendered as part of the first port in the range
+			continue
+		}
+		addresses := make(map[string]string, len(pool.addresses))
+		fallbackAddresses := make(map[string]string, len(pool.backupAddresses))
+		for port := pool.sourceRange.First; port <= pool.sourceRange.Last; port++ {
+			rangeListener := listener
+			rangeListener.Port = port
+			for address, zone := range p[rangeListener].addresses {
+				addresses[address] = zone
+			}
+			for address, zone := range p[rangeListener].backupAddresses {
+				fallbackAddresses[address] = zone
+			}
+		}
+		addressList, backupAddressList := splitByZone(addresses, pool.preferredZone)
+		backupAddressList = appendFallbacks(backupAddressList, addresses, fallbackAddresses)
+		name := listener.Name()
+		if pool.sourceRange.IsRange() {
+			name = fmt.Sprintf("%s_%d", name, pool.sourceRange.Last)
 		}
-		ports = append(ports, PortVars{SourcePort: port, DestPort: pool.destPort, Addresses: addressList})
+		ports = append(ports, PortVars{
+			Name:            name,
+			Pool:            pool.pool,
+			Protocol:        strings.ToLower(string(protocol)),
+			ListenAddress:   listener.Address,
+			SourcePort:      pool.sourceRange.First,
+			SourcePortEnd:   pool.sourceRange.Last,
+			DestPort:        pool.destPort,
+			DestPortEnd:     pool.destPort + pool.sourceRange.Last - pool.sourceRange.First,
+			Addresses:       addressList,
+			BackupAddresses: backupAddressList,
+			Zones:           zoneVars(addresses),
+			PortOptions:     pool.options,
+		})
 	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].SourcePort != ports[j].SourcePort {
+			return ports[i].SourcePort < ports[j].SourcePort
+		}
+		return ports[i].ListenAddress < ports[j].ListenAddress
+	})
 	return ports
 }
 
 type PortVars struct {
-	SourcePort int      `json:"srcPort"`
-	DestPort   int      `json:"destPort"`
-	Addresses  []string `json:"addresses"`
+	// Name uniquely identifies the listener, and is safe to use as part of an identifier, e.g. an upstream name
+	Name string `json:"name"`
+	// Pool is the name of the pool the port is from
+	Pool string `json:"pool"`
+	// Protocol is tcp or udp
+	Protocol      string `json:"protocol"`
+	ListenAddress string `json:"listenAddress"`
+	SourcePort    int    `json:"srcPort"`
+	// SourcePortEnd is the last port of a range, or the same as SourcePort if this is not a range
+	SourcePortEnd int `json:"srcPortEnd"`
+	DestPort      int `json:"destPort"`
+	// DestPortEnd is the port SourcePortEnd is mapped to
+	DestPortEnd int      `json:"destPortEnd"`
+	Addresses   []string `json:"addresses"`
+	// BackupAddresses are addresses which should only be used if all of Addresses are unavailable, e.g. those outside of a preferred zone, or from fallback pools
+	BackupAddresses []string `json:"backupAddresses"`
+	// Zones are all of the addresses, including backups, grouped by zone
+	Zones       []ZoneVars `json:"zones"`
+	PortOptions `json:",inline"`
+}
+
+// ZoneVars are the addresses in a single topology zone. Addresses without a known zone have an empty zone.
+type ZoneVars struct {
+	Zone      string   `json:"zone"`
+	Addresses []string `json:"addresses"`
+}
+
+// PortPair is a single source port and the destination port it is mapped to
+type PortPair struct {
+	SourcePort int `json:"srcPort"`
+	DestPort   int `json:"destPort"`
+}
+
+// IsRange returns true if this listener is for more than one port
+func (p PortVars) IsRange() bool {
+	return p.SourcePort != p.SourcePortEnd
+}
+
+// Ports returns each individual source port and its destination, which is a single pair if this is not a range
+func (p PortVars) Ports() []PortPair {
+	pairs := make([]PortPair, 0, p.SourcePortEnd-p.SourcePort+1)
+	for port := p.SourcePort; port <= p.SourcePortEnd; port++ {
+		pairs = append(pairs, PortPair{SourcePort: port, DestPort: p.DestPort + port - p.SourcePort})
+	}
+	return pairs
+}
+
+// Listen returns the address and port(s) to listen on, in the form address:port or address:first-last, omitting the address if listening on all addresses
+func (p PortVars) Listen() string {
+	ports := strconv.Itoa(p.SourcePort)
+	if p.IsRange() {
+		ports = fmt.Sprintf("%d-%d", p.SourcePort, p.SourcePortEnd)
+	}
+	if p.ListenAddress == "" {
+		return ports
+	}
+	return net.JoinHostPort(p.ListenAddress, ports)
 }
 
 type TemplateVars struct {
 	TCPPorts []PortVars `json:"tcp"`
 	UDPPorts []PortVars `json:"udp"`
+	// HTTPHosts are the hosts from Ingresses, if enabled
+	HTTPHosts []HostVars `json:"hosts"`
+	// TLSSecrets are the TLS secrets which have been written to disk
+	TLSSecrets []TLSSecretVars `json:"tlsSecrets"`
 }
 
+// MinRetryInterval and MaxRetryInterval bound how long to wait before restarting all watches after one fails, which doubles after each failure
+const (
+	MinRetryInterval = time.Second
+	MaxRetryInterval = time.Minute
+)
+
 func (d *Doorman) Run(ctx context.Context, stop <-chan struct{}) error {
-	tcpPools := make(portPools)
-	udpPools := make(portPools)
-	events := make(chan NodeEvent)
-	fmt.Println("Starting node pool watchers")
-	for _, pool := range d.nodePools {
-		fmt.Printf("Starting watches for pool %s\n", pool.name)
-		go func(pool NodePoolDescription) {
-			err := (&PoolWatcher{
-				kubernetesAPIs: d.kubernetesAPIs,
-				pool:           pool,
-			}).Run(ctx, events, stop)
+	if d.health != nil {
+		go func() {
+			err := d.health.Run(ctx, stop)
 			if err != nil {
-				fmt.Printf("Watcher failed: %v\n", err)
+				fmt.Printf("Health endpoint failed: %v\n", err)
 			}
-		}(pool)
-		for _, port := range pool.tcpPorts {
-			tcpPools.init(port)
-		}
-		for _, port := range pool.udpPorts {
-			udpPools.init(port)
-		}
+		}()
 	}
-	// TODO: Serve health endpoint
 	// TODO: Serve metrics
 	// TODO: Define and populate metrics
 
+	var lastVars *TemplateVars
+	// rotated is set if a TLS secret's files changed, which requires the actions to run even if the template variables did not change
+	rotated := false
+	guards := newGuardState(d.guards())
+
+	if d.stateFile != "" {
+		saved, err := loadState(d.stateFile)
+		if err != nil {
+			fmt.Printf("Not using saved state: %v\n", err)
+		} else if saved != nil {
+			fmt.Printf("Rendering saved state from %s until all watches have synced\n", d.stateFile)
+			guards.apply(saved.members(), time.Now())
+			lastVars = &saved.Vars
+			d.restoreGeneration(saved)
+			d.apply(ctx, saved.Vars, false)
+		}
+	}
+
+	session := d.startWatches(ctx, false)
+	// relist is the session listing everything from scratch for a resync, alongside the watches, which has no channels while there is none
+	relist := &watchSession{}
+	relisting := false
+	stopRelist := func() {
+		if relisting {
+			relist.close()
+			relist = &watchSession{}
+			relisting = false
+		}
+	}
+	defer func() {
+		session.close()
+		stopRelist()
+	}()
+	var retry <-chan time.Time
+	retryInterval := MinRetryInterval
+	// guardTimer fires when a tripped guard's stabilization period ends
+	var guardTimer <-chan time.Time
+	var resync <-chan time.Time
+	if d.resyncInterval != 0 {
+		ticker := time.NewTicker(d.resyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+	// resyncing is set from when a relist replaces the watched state until the result is applied
+	resyncing := false
+	var templateCheck <-chan time.Time
+	for _, file := range d.templates {
+		if file.watchesFiles() {
+			ticker := time.NewTicker(TemplateCheckInterval)
+			defer ticker.Stop()
+			templateCheck = ticker.C
+			break
+		}
+	}
+
 	fmt.Println("Listening for events from watchers...")
 
-	for event := range events {
-		fmt.Printf("Got event %#v\n", event)
-		var pools portPools
-		var port int
-		if event.Port.TCP != nil {
-			pools = tcpPools
-			port = *event.Port.TCP
-		} else {
-			pools = udpPools
-			port = *event.Port.UDP
-		}
-		updated := false
-		switch event.Type {
-		case watch.Added:
-			updated = pools.add(port, event.Address)
-		case watch.Deleted:
-			updated = pools.remove(port, event.Address)
-			// TODO: Handle remaining events
-			// Error: ???
-		}
-		if !updated {
-			fmt.Print("Event did not change state, not regenerating templates")
+	for {
+		override := false
+		state := session.state
+		select {
+		// Events from the watches are also applied to a relist in progress, as they may be newer than what it listed
+		case event := <-session.events:
+			fmt.Printf("Got event %#v\n", event)
+			state.applyNodeEvent(event)
+			if relisting {
+				relist.state.applyNodeEvent(event)
+			}
+		case event := <-session.serviceEvents:
+			fmt.Printf("Got service event %#v\n", event)
+			state.applyServicePortsEvent(event)
+			if relisting {
+				relist.state.applyServicePortsEvent(event)
+			}
+		case event := <-session.endpointSliceEvents:
+			fmt.Printf("Got endpoint slice event %#v\n", event)
+			state.applyEndpointSliceEvent(event)
+			if relisting {
+				relist.state.applyEndpointSliceEvent(event)
+			}
+		case event := <-session.ingressEvents:
+			fmt.Printf("Got ingress event %#v\n", event)
+			state.applyIngressEvent(event)
+			if relisting {
+				relist.state.applyIngressEvent(event)
+			}
+		case event := <-session.tlsSecretEvents:
+			fmt.Printf("Got TLS secret event %#v\n", event)
+			state.applyTLSSecretEvent(event)
+			if relisting {
+				relist.state.applyTLSSecretEvent(event)
+			}
+			rotated = rotated || event.Changed
+		case name := <-session.synced:
+			delete(session.pending, name)
+			fmt.Printf("Got initial list from %s\n", name)
+			if session.isSynced() {
+				fmt.Println("All watches have synced")
+				retryInterval = MinRetryInterval
+			}
+		case err := <-session.errs:
+			fmt.Printf("Restarting all watches in %v: %v\n", retryInterval, err)
+			// The new session lists everything from scratch anyway
+			stopRelist()
+			session.close()
+			session = restartingSession()
+			retry = time.After(retryInterval)
+			retryInterval *= 2
+			if retryInterval > MaxRetryInterval {
+				retryInterval = MaxRetryInterval
+			}
+		case <-retry:
+			retry = nil
+			session = d.startWatches(ctx, false)
+		case <-resync:
+			if !session.isSynced() {
+				fmt.Println("Not resyncing, watches have not finished their initial lists")
+				continue
+			}
+			if relisting {
+				fmt.Println("Not resyncing, the previous resync has not finished listing")
+				continue
+			}
+			fmt.Println("Resyncing, listing everything again")
+			relist = d.startWatches(ctx, true)
+			relisting = true
+			continue
+		case event := <-relist.events:
+			relist.state.applyNodeEvent(event)
+			continue
+		case event := <-relist.serviceEvents:
+			relist.state.applyServicePortsEvent(event)
+			continue
+		case event := <-relist.endpointSliceEvents:
+			relist.state.applyEndpointSliceEvent(event)
+			continue
+		case event := <-relist.ingressEvents:
+			relist.state.applyIngressEvent(event)
+			continue
+		case event := <-relist.tlsSecretEvents:
+			relist.state.applyTLSSecretEvent(event)
+			continue
+		case name := <-relist.synced:
+			delete(relist.pending, name)
+			if !relist.isSynced() {
+				continue
+			}
+			// The watches keep running, and now update the relisted state, which is rendered and compared against the last render
+			fmt.Println("Resync finished listing, replacing the watched state")
+			relist.state.copyLoadBalancerPorts(session.state)
+			session.state = relist.state
+			stopRelist()
+			resyncing = true
+		case err := <-relist.errs:
+			fmt.Printf("Resync failed, keeping the watched state: %v\n", err)
+			stopRelist()
+			continue
+		case <-guardTimer:
+			guardTimer = nil
+		case <-templateCheck:
+			if d.reloadTemplates() && lastVars != nil {
+				fmt.Println("Templates changed, regenerating with the last state")
+				d.apply(ctx, *lastVars, false)
+			}
+			continue
+		case <-d.overrides:
+			fmt.Println("Overriding guards")
+			override = true
+		case <-stop:
+			return nil
+		}
+		if !session.isSynced() {
+			// Rendering now would drop anything which has not been listed yet, so keep the last render until everything has been
+			if d.health != nil {
+				d.health.SetProblems("watches", []string{fmt.Sprintf("Waiting for initial lists from: %s", session.pendingWatchers())})
+			}
+			continue
+		}
+		if d.health != nil {
+			d.health.SetProblems("watches", nil)
+		}
+		state = session.state
+		members := state.members()
+		now := time.Now()
+		problems, next := guards.check(members, now)
+		if len(problems) != 0 && !override {
+			fmt.Printf("Not regenerating templates, guards are tripped, send SIGUSR1 to override: %v\n", problems)
+			if d.health != nil {
+				d.health.SetProblems("guards", problems)
+			}
+			if !next.IsZero() {
+				guardTimer = time.After(time.Until(next))
+			}
+			continue
+		}
+		if d.health != nil {
+			d.health.SetProblems("guards", nil)
+		}
+		listeners := d.listeners(state)
+		templateVars := TemplateVars{
+			TCPPorts:   listeners.render(corev1.ProtocolTCP),
+			UDPPorts:   listeners.render(corev1.ProtocolUDP),
+			HTTPHosts:  d.hosts(state),
+			TLSSecrets: state.tlsSecretVars(),
+		}
+		guards.apply(members, now)
+		// After a resync, the files are always rendered, to find any which were edited since the last render
+		resynced := resyncing
+		resyncing = false
+		if resynced && lastVars != nil {
+			for _, change := range diffVars(*lastVars, templateVars) {
+				fmt.Printf("Drift: %s\n", change)
+			}
+		}
+		if lastVars != nil && reflect.DeepEqual(*lastVars, templateVars) && !rotated && !resynced {
+			fmt.Println("Event did not change state, not regenerating templates")
+			d.saveState(members, templateVars)
 			continue
 		}
+		lastVars = &templateVars
+		force := rotated
+		rotated = false
 		// TODO: Implement some sort of throttling so that only one re-template
 		// happens per "chunk" of activity
-		fmt.Println("Regenerating templates")
-		templateVars := TemplateVars{
-			TCPPorts: tcpPools.render(),
-			UDPPorts: udpPools.render(),
+		if d.apply(ctx, templateVars, force) {
+			d.saveState(members, templateVars)
 		}
-		for _, templater := range d.templates {
-			err := templater.Template(templateVars)
+	}
+}
+
+// apply renders the templates, and performs the post-template actions if any file changed or force is set, returning true if all templates were rendered.
+func (d *Doorman) apply(ctx context.Context, templateVars TemplateVars, force bool) bool {
+	ok := true
+	changed := false
+	var problems []string
+	now := time.Now()
+	meta := d.generate(templateVars, now)
+	fmt.Printf("Regenerating templates for generation %d\n", meta.Generation)
+	// current is every file rendered, so that stale files are never those of another template
+	current := make(map[string]struct{})
+	// complete are the templates which rendered all of their files, so any others they own are stale
+	complete := make([]*ManagedFile, 0)
+	for ix := range d.templates {
+		file := &d.templates[ix]
+		rendered, err := file.files(templateVars, meta)
+		if err != nil {
+			fmt.Printf("Templating failed: %v\n", err)
+			ok = false
+			continue
+		}
+		allRendered := true
+		for _, r := range rendered {
+			current[r.path] = struct{}{}
+			renderCtx, cancel := context.WithTimeout(ctx, file.timeout)
+			data, err := file.templater.Render(renderCtx, r.path, r.vars)
+			cancel()
 			if err != nil {
-				fmt.Printf("Templating failed: %v\n", err)
+				fmt.Printf("Templating %s failed: %v\n", r.path, err)
+				ok = false
+				allRendered = false
+				continue
 			}
-		}
-		fmt.Println("Performing post-template actions")
-		for _, action := range d.actions {
-			err := action.Do(ctx)
+			fileChanged, problem, err := file.write(r.path, data, now)
 			if err != nil {
-				fmt.Printf("Failed post-template action: %v\n", err)
+				fmt.Printf("Writing %s failed: %v\n", r.path, err)
+				ok = false
+				continue
+			}
+			if problem != "" {
+				problems = append(problems, problem)
+				ok = false
 			}
+			changed = changed || fileChanged
+		}
+		if file.forEach != "" && allRendered {
+			complete = append(complete, file)
 		}
 	}
-	return nil
+	for _, file := range complete {
+		removed, fileProblems, err := file.removeStale(current, now)
+		if err != nil {
+			fmt.Printf("Removing stale files matching %s failed: %v\n", file.path, err)
+			ok = false
+		}
+		if len(fileProblems) != 0 {
+			problems = append(problems, fileProblems...)
+			ok = false
+		}
+		changed = changed || removed
+	}
+	if d.health != nil {
+		d.health.SetProblems("drift", problems)
+	}
+	if !changed && !force {
+		fmt.Println("No files changed, not performing post-template actions")
+		return ok
+	}
+	fmt.Println("Performing post-template actions")
+	for _, action := range d.actions {
+		err := action.Do(ctx)
+		if err != nil {
+			fmt.Printf("Failed post-template action: %v\n", err)
+		}
+	}
+	return ok
 }
 
-type Port struct {
-	TCP *int
-	UDP *int
+// saveState saves the applied state to the state file, if there is one
+func (d *Doorman) saveState(members map[string]map[string]struct{}, templateVars TemplateVars) {
+	if d.stateFile == "" {
+		return
+	}
+	if err := saveState(d.stateFile, members, templateVars, d.meta); err != nil {
+		fmt.Printf("Saving state to %s failed: %v\n", d.stateFile, err)
+	}
 }
 
 // Templater intantiates a template using variables
 type Templater interface {
-	Template(in interface{}) error
+	// Path is the file the template is written to
+	Path() string
+	// Render produces the contents of the file at a path, which is Path unless the template renders a file for each pool or port, stopping if the context is cancelled
+	Render(ctx context.Context, path string, in interface{}) ([]byte, error)
 }
 
 type Action interface {
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+// countingAction counts how many times it was performed
+type countingAction struct {
+	count int
+}
+
+func (c *countingAction) Do(ctx context.Context) error {
+	c.count++
+	return nil
+}
+
+func TestDoormanApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doorman-apply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "doorman.conf")
+	action := &countingAction{}
+	d := Doorman{templates: make([]ManagedFile, 1), actions: []Action{action}}
+	if err := d.templates[0].FromConfig(&public.Template{Path: path, Template: "{{ range .TCPPorts }}{{ .Name }} {{ end }}"}); err != nil {
+		t.Fatal(err)
+	}
+	vars := TemplateVars{TCPPorts: []PortVars{{Name: "tcp_80"}}}
+	expect := func(templateVars TemplateVars, force bool, want string, wantCount int) {
+		t.Helper()
+		if !d.apply(context.Background(), templateVars, force) {
+			t.Fatal("Templates were not all rendered")
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("Got %q, want %q", data, want)
+		}
+		if action.count != wantCount {
+			t.Errorf("Actions were performed %d times, want %d", action.count, wantCount)
+		}
+	}
+	expect(vars, false, "tcp_80 ", 1)
+	// Rendering the same state again, e.g. saved state on startup, does not perform the actions unless forced
+	expect(vars, false, "tcp_80 ", 1)
+	expect(vars, true, "tcp_80 ", 2)
+	expect(TemplateVars{TCPPorts: []PortVars{{Name: "tcp_80"}, {Name: "tcp_443"}}}, false, "tcp_80 tcp_443 ", 3)
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+// stampPath returns the path of the file which holds the hash of what was last rendered to a file
+func stampPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".doorman-sha256")
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readStamp returns the hash of what was last rendered to a file, and the path pattern of the template which rendered it, or empty strings if the file was never stamped
+func readStamp(path string) (hash string, owner string, err error) {
+	stamp, err := ioutil.ReadFile(stampPath(path))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.SplitN(strings.TrimSpace(string(stamp)), "\n", 2)
+	hash = lines[0]
+	if len(lines) == 2 {
+		owner = lines[1]
+	}
+	return hash, owner, nil
+}
+
+// edited returns the contents of a file if it was changed since it was last rendered.
+// A file which does not exist, or was never stamped, e.g. because it existed before doorman managed it, is not edited.
+func edited(path string) ([]byte, error) {
+	existing, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hash, _, err := readStamp(path)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" || hash == contentHash(existing) {
+		return nil, nil
+	}
+	return existing, nil
+}
+
+// saveAside copies the edited contents of a file next to it, so they are not lost
+func saveAside(path string, existing []byte, now time.Time) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	aside := fmt.Sprintf("%s.edited-%s", path, now.Format("20060102T150405"))
+	if _, err := writeFileIfChanged(aside, existing, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("Saving edited copy of %s failed: %v", path, err)
+	}
+	return aside, nil
+}
+
+// write writes rendered data to a file if it changed, following the drift policy if the file was edited since it was last rendered, and stamps it with the hash of the data and the path pattern of the template.
+// Returns true if the file was written, and a problem if the drift policy refused to write it.
+func (m *ManagedFile) write(path string, data []byte, now time.Time) (bool, string, error) {
+	existing, err := edited(path)
+	if err != nil {
+		return false, "", err
+	}
+	if existing != nil && !bytes.Equal(existing, data) {
+		switch m.driftPolicy {
+		case public.DriftPolicyRefuse:
+			fmt.Printf("Drift: %s was edited since it was last rendered, not overwriting it\n", path)
+			return false, fmt.Sprintf("%s was edited since it was last rendered, remove it or %s to render it again", path, stampPath(path)), nil
+		case public.DriftPolicySaveAside:
+			aside, err := saveAside(path, existing, now)
+			if err != nil {
+				return false, "", err
+			}
+			fmt.Printf("Drift: %s was edited since it was last rendered, saved the edited copy to %s and overwriting it\n", path, aside)
+		default:
+			fmt.Printf("Drift: %s was edited since it was last rendered, overwriting it\n", path)
+		}
+	}
+	changed, err := writeFile(path, data, m.options)
+	if err != nil {
+		return false, "", err
+	}
+	if _, err := writeFileIfChanged(stampPath(path), []byte(contentHash(data)+"\n"+m.path+"\n"), 0644); err != nil {
+		return changed, "", err
+	}
+	return changed, "", nil
+}
+
+// removeStale removes the files matching the path pattern of a template which doorman rendered, but are no longer current, following the drift policy if they were edited since they were last rendered.
+// Files which were never stamped are not doorman's, and files stamped by another template, which may have failed to render them, are not this template's, so both are left alone.
+// Returns true if any file was removed, and a problem for each file the drift policy refused to remove.
+func (m *ManagedFile) removeStale(current map[string]struct{}, now time.Time) (bool, []string, error) {
+	paths, err := filepath.Glob(m.pathGlob)
+	if err != nil {
+		return false, nil, err
+	}
+	removed := false
+	var problems []string
+	for _, path := range paths {
+		if _, ok := current[path]; ok || strings.HasSuffix(path, ".doorman-sha256") {
+			continue
+		}
+		if _, owner, err := readStamp(path); err != nil {
+			return removed, problems, err
+		} else if owner != m.path {
+			continue
+		}
+		existing, err := edited(path)
+		if err != nil {
+			return removed, problems, err
+		}
+		if existing != nil {
+			switch m.driftPolicy {
+			case public.DriftPolicyRefuse:
+				fmt.Printf("Drift: %s was edited since it was last rendered, not removing it\n", path)
+				problems = append(problems, fmt.Sprintf("%s is stale but was edited since it was last rendered, remove it and %s", path, stampPath(path)))
+				continue
+			case public.DriftPolicySaveAside:
+				aside, err := saveAside(path, existing, now)
+				if err != nil {
+					return removed, problems, err
+				}
+				fmt.Printf("Drift: %s was edited since it was last rendered, saved the edited copy to %s and removing it\n", path, aside)
+			default:
+				fmt.Printf("Drift: %s was edited since it was last rendered, removing it\n", path)
+			}
+		}
+		fmt.Printf("Removing stale file %s\n", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, problems, err
+		}
+		if err := os.Remove(stampPath(path)); err != nil && !os.IsNotExist(err) {
+			return true, problems, err
+		}
+		removed = true
+	}
+	return removed, problems, nil
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReadStamp(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "doorman.conf")
+	if hash, owner, err := readStamp(path); err != nil || hash != "" || owner != "" {
+		t.Errorf("Got %q, %q, %v for a file which was never stamped", hash, owner, err)
+	}
+	// Stamps from before the owner was recorded only have a hash
+	if err := ioutil.WriteFile(stampPath(path), []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash, owner, err := readStamp(path); err != nil || hash != "abc" || owner != "" {
+		t.Errorf("Got %q, %q, %v, want abc without an owner", hash, owner, err)
+	}
+	if err := ioutil.WriteFile(stampPath(path), []byte("abc\n/etc/doorman/*.conf\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hash, owner, err := readStamp(path); err != nil || hash != "abc" || owner != "/etc/doorman/*.conf" {
+		t.Errorf("Got %q, %q, %v, want abc owned by /etc/doorman/*.conf", hash, owner, err)
+	}
+}
+
+func TestManagedFileWrite(t *testing.T) {
+	now := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name        string
+		policy      public.DriftPolicy
+		wantWritten bool
+		wantProblem bool
+		wantContent string
+		wantAside   bool
+	}{
+		{name: "overwrite", policy: public.DriftPolicyOverwrite, wantWritten: true, wantContent: "rendered again\n"},
+		{name: "refuse", policy: public.DriftPolicyRefuse, wantProblem: true, wantContent: "edited\n"},
+		{name: "save aside", policy: public.DriftPolicySaveAside, wantWritten: true, wantContent: "rendered again\n", wantAside: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "doorman.conf")
+			m := ManagedFile{path: path, driftPolicy: c.policy, options: fileOptions{uid: -1, gid: -1}}
+			if written, problem, err := m.write(path, []byte("rendered\n"), now); err != nil || !written || problem != "" {
+				t.Fatalf("Got %v, %q, %v from the first write", written, problem, err)
+			}
+			if hash, owner, err := readStamp(path); err != nil || hash != contentHash([]byte("rendered\n")) || owner != path {
+				t.Fatalf("Got stamp %q, %q, %v after the first write", hash, owner, err)
+			}
+			// Writing the same data again does nothing
+			if written, problem, err := m.write(path, []byte("rendered\n"), now); err != nil || written || problem != "" {
+				t.Fatalf("Got %v, %q, %v from writing the same data", written, problem, err)
+			}
+
+			if err := ioutil.WriteFile(path, []byte("edited\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			written, problem, err := m.write(path, []byte("rendered again\n"), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != c.wantWritten || (problem != "") != c.wantProblem {
+				t.Errorf("Got %v, %q, want written %v and a problem %v", written, problem, c.wantWritten, c.wantProblem)
+			}
+			if got := readFile(t, path); got != c.wantContent {
+				t.Errorf("Got %q, want %q", got, c.wantContent)
+			}
+			aside := path + ".edited-20210901T120000"
+			if _, err := os.Stat(aside); (err == nil) != c.wantAside {
+				t.Errorf("Edited copy exists: %v, want %v", err == nil, c.wantAside)
+			} else if c.wantAside && readFile(t, aside) != "edited\n" {
+				t.Errorf("Edited copy has %q", readFile(t, aside))
+			}
+		})
+	}
+
+	// Editing a file back to what is rendered is not drift
+	path := filepath.Join(t.TempDir(), "doorman.conf")
+	m := ManagedFile{path: path, driftPolicy: public.DriftPolicyRefuse, options: fileOptions{uid: -1, gid: -1}}
+	if _, _, err := m.write(path, []byte("rendered\n"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("rendered again\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if written, problem, err := m.write(path, []byte("rendered again\n"), now); err != nil || written || problem != "" {
+		t.Errorf("Got %v, %q, %v from rendering what the file was edited to", written, problem, err)
+	}
+}
+
+func TestManagedFileRemoveStale(t *testing.T) {
+	dir := t.TempDir()
+	pattern := filepath.Join(dir, "{{ .Name }}.conf")
+	m := ManagedFile{path: pattern, pathGlob: filepath.Join(dir, "*.conf"), driftPolicy: public.DriftPolicyRefuse, options: fileOptions{uid: -1, gid: -1}}
+	now := time.Now()
+	for _, name := range []string{"current", "stale", "edited"} {
+		if _, _, err := m.write(filepath.Join(dir, name+".conf"), []byte(name+"\n"), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "edited.conf"), []byte("by hand\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A file which was never stamped, and one stamped by another template, are not this template's
+	if err := ioutil.WriteFile(filepath.Join(dir, "unmanaged.conf"), []byte("unmanaged\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := ManagedFile{path: filepath.Join(dir, "other.conf"), driftPolicy: public.DriftPolicyOverwrite, options: fileOptions{uid: -1, gid: -1}}
+	if _, _, err := other.write(filepath.Join(dir, "other.conf"), []byte("other\n"), now); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, problems, err := m.removeStale(map[string]struct{}{filepath.Join(dir, "current.conf"): {}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed || len(problems) != 1 {
+		t.Errorf("Got %v, %v, want a removed file and a problem for the edited one", removed, problems)
+	}
+	var left []string
+	paths, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		left = append(left, filepath.Base(path))
+	}
+	want := []string{"current.conf", "edited.conf", "other.conf", "unmanaged.conf"}
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("Got %v left, want %v", left, want)
+	}
+	if _, err := os.Stat(stampPath(filepath.Join(dir, "stale.conf"))); !os.IsNotExist(err) {
+		t.Errorf("The stamp of the removed file was not removed: %v", err)
+	}
+}
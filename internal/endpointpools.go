@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"reflect"
+	"sort"
+	"strings"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+// EndpointPortMapping is a mapping from a port to listen on to the named port of a service's endpoints
+type EndpointPortMapping struct {
+	Source   int
+	PortName string
+	Address  string
+	Protocol corev1.Protocol
+	PortOptions
+}
+
+func (p *EndpointPortMapping) FromConfig(cfg public.EndpointPortMapping, protocol corev1.Protocol) error {
+	if err := (public.PortRange{First: cfg.Source, Last: cfg.Source}).Validate(); err != nil {
+		return err
+	}
+	p.Source = cfg.Source
+	p.PortName = cfg.PortName
+	p.Address = cfg.ListenAddress
+	p.Protocol = protocol
+	p.PortOptions.FromConfig(cfg.PortOptions)
+	return nil
+}
+
+// Listener returns the address, protocol, and port the load balancer listens on for this mapping
+func (p *EndpointPortMapping) Listener() Listener {
+	return Listener{Address: p.Address, Protocol: p.Protocol, Port: p.Source}
+}
+
+// EndpointPoolDescription is a pool whose members are the ready endpoints of a service
+type EndpointPoolDescription struct {
+	name          string
+	service       string
+	ports         []EndpointPortMapping
+	addressType   discoveryv1.AddressType
+	preferredZone string
+	guard         *GuardDescription
+}
+
+func (e *EndpointPoolDescription) FromConfig(cfg *public.EndpointPoolConfigFile) error {
+	if cfg.Service.Name == "" {
+		return fmt.Errorf("A service name is required")
+	}
+	e.name = cfg.Name
+	e.service = cfg.Service.Key()
+	e.ports = make([]EndpointPortMapping, len(cfg.TCPPorts)+len(cfg.UDPPorts))
+	for i, port := range cfg.TCPPorts {
+		if err := e.ports[i].FromConfig(port, corev1.ProtocolTCP); err != nil {
+			return err
+		}
+	}
+	for i, port := range cfg.UDPPorts {
+		if err := e.ports[len(cfg.TCPPorts)+i].FromConfig(port, corev1.ProtocolUDP); err != nil {
+			return err
+		}
+	}
+	e.addressType = cfg.AddressType
+	e.preferredZone = cfg.PreferredZone
+	if cfg.Guard != nil {
+		e.guard = &GuardDescription{}
+		if err := e.guard.FromConfig(cfg.Guard); err != nil {
+			return fmt.Errorf("Invalid guard: %v", err)
+		}
+	}
+	return nil
+}
+
+// EndpointPoolWatcher maintains the members and ports of an endpoint pool from the EndpointSlices of its service,
+// sending the members as nodes, and the ports as if they were discovered from the service
+type EndpointPoolWatcher struct {
+	kubernetesAPIs []kubernetes.Interface
+	pool           EndpointPoolDescription
+	// synced, if not nil, is called once the members and ports from the initial list of endpoint slices have been sent
+	synced func()
+	// listOnly, if set, stops the watcher once the members and ports from the initial list have been sent, instead of watching for changes
+	listOnly bool
+}
+
+// members returns the ready addresses of all slices, and their zones
+func (e *EndpointPoolWatcher) members(slices map[string]EndpointSliceEvent) map[string]string {
+	members := make(map[string]string)
+	for _, slice := range slices {
+		if e.pool.addressType != "" && slice.AddressType != e.pool.addressType {
+			continue
+		}
+		for _, address := range slice.Addresses {
+			members[address] = slice.Zones[address]
+		}
+	}
+	return members
+}
+
+// ports resolves the endpoint port number of each port mapping. If the slices disagree, e.g. during a rollout which changes
+// the port, the lowest is used. Mappings whose port cannot be found are omitted.
+func (e *EndpointPoolWatcher) ports(slices map[string]EndpointSliceEvent) []PortMapping {
+	ports := make([]PortMapping, 0, len(e.pool.ports))
+	for _, mapping := range e.pool.ports {
+		found := make([]int, 0, 1)
+		for _, slice := range slices {
+			if e.pool.addressType != "" && slice.AddressType != e.pool.addressType {
+				continue
+			}
+			for _, port := range slice.Ports {
+				name := ""
+				if port.Name != nil {
+					name = *port.Name
+				}
+				protocol := corev1.ProtocolTCP
+				if port.Protocol != nil {
+					protocol = *port.Protocol
+				}
+				if name == mapping.PortName && protocol == mapping.Protocol && port.Port != nil {
+					found = append(found, int(*port.Port))
+				}
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		sort.Ints(found)
+		if found[0] != found[len(found)-1] {
+			fmt.Printf("Endpoints of service %s have different ports for %q in pool %s, using %d\n", e.pool.service, mapping.PortName, e.pool.name, found[0])
+		}
+		ports = append(ports, PortMapping{
+			Source:      mapping.Source,
+			Dest:        found[0],
+			Address:     mapping.Address,
+			Protocol:    mapping.Protocol,
+			Range:       public.PortRange{First: mapping.Source, Last: mapping.Source},
+			PortOptions: mapping.PortOptions,
+		})
+	}
+	return ports
+}
+
+func (e *EndpointPoolWatcher) Run(ctx context.Context, events chan<- NodeEvent, serviceEvents chan<- ServicePortsEvent, stop <-chan struct{}) error {
+	sliceEvents := make(chan EndpointSliceEvent)
+	watcherStop := make(chan struct{})
+	defer close(watcherStop)
+	namespace := strings.SplitN(e.pool.service, "/", 2)[0]
+	name := strings.SplitN(e.pool.service, "/", 2)[1]
+	errs := make(chan error, 1)
+	slicesSynced := make(chan struct{})
+	go func() {
+		errs <- (&EndpointSliceWatcher{
+			kubernetesAPIs: e.kubernetesAPIs,
+			namespace:      namespace,
+			labelSelector:  labels.Set{discoveryv1.LabelServiceName: name}.String(),
+			listOnly:       e.listOnly,
+			synced: func() {
+				select {
+				case slicesSynced <- struct{}{}:
+				case <-watcherStop:
+				}
+			},
+		}).Run(ctx, sliceEvents, watcherStop)
+	}()
+
+	slices := make(map[string]EndpointSliceEvent)
+	members := make(map[string]string)
+	var ports []PortMapping
+	for {
+		select {
+		case event := <-sliceEvents:
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if event.Service != e.pool.service {
+					continue
+				}
+				slices[event.Slice] = event
+			case watch.Deleted:
+				delete(slices, event.Slice)
+			}
+		case <-slicesSynced:
+			// Every slice in the initial list was received, and sent as members and ports, before this
+			notifySynced(e.synced)
+			if e.listOnly {
+				return nil
+			}
+			continue
+		case err := <-errs:
+			return err
+		case <-stop:
+			return nil
+		}
+
+		newMembers := e.members(slices)
+		for member := range members {
+			if _, ok := newMembers[member]; !ok {
+				fmt.Printf("Endpoint left pool %s: %s\n", e.pool.name, member)
+				select {
+				case events <- NodeEvent{Type: watch.Deleted, Pool: e.pool.name, Node: member}:
+				case <-stop:
+					return nil
+				}
+			}
+		}
+		for member, zone := range newMembers {
+			if oldZone, ok := members[member]; !ok || oldZone != zone {
+				fmt.Printf("Endpoint in pool %s: %s, %q\n", e.pool.name, member, zone)
+				select {
+				case events <- NodeEvent{Type: watch.Modified, Pool: e.pool.name, Node: member, Addresses: []string{member}, Zone: zone}:
+				case <-stop:
+					return nil
+				}
+			}
+		}
+		members = newMembers
+
+		newPorts := e.ports(slices)
+		if !reflect.DeepEqual(ports, newPorts) {
+			fmt.Printf("Endpoint ports for pool %s: %v\n", e.pool.name, newPorts)
+			select {
+			case serviceEvents <- ServicePortsEvent{Pool: e.pool.name, Service: e.pool.service, Ports: newPorts}:
+			case <-stop:
+				return nil
+			}
+		}
+		ports = newPorts
+	}
+}
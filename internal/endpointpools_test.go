@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestEndpointPoolDescriptionFromConfig(t *testing.T) {
+	var e EndpointPoolDescription
+	err := e.FromConfig(&public.EndpointPoolConfigFile{
+		Name:     "api",
+		Service:  public.ServiceReference{Name: "api"},
+		TCPPorts: []public.EndpointPortMapping{{Source: 80, PortName: "http"}},
+		UDPPorts: []public.EndpointPortMapping{{Source: 53, PortName: "dns", ListenAddress: "10.0.0.10"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.service != "default/api" {
+		t.Errorf("Got service %s, want default/api", e.service)
+	}
+	want := []EndpointPortMapping{
+		{Source: 80, PortName: "http", Protocol: corev1.ProtocolTCP},
+		{Source: 53, PortName: "dns", Address: "10.0.0.10", Protocol: corev1.ProtocolUDP},
+	}
+	if !reflect.DeepEqual(e.ports, want) {
+		t.Errorf("Got ports %+v, want %+v", e.ports, want)
+	}
+
+	if err := e.FromConfig(&public.EndpointPoolConfigFile{Name: "api"}); err == nil {
+		t.Error("Expected an error for a pool without a service")
+	}
+	if err := e.FromConfig(&public.EndpointPoolConfigFile{Name: "api", Service: public.ServiceReference{Name: "api"}, TCPPorts: []public.EndpointPortMapping{{Source: 0}}}); err == nil {
+		t.Error("Expected an error for a port outside of 1-65535")
+	}
+}
+
+func TestEndpointPoolWatcherMembersAndPorts(t *testing.T) {
+	name := func(name string) *string { return &name }
+	port := func(port int32) *int32 { return &port }
+	udp := corev1.ProtocolUDP
+	slices := map[string]EndpointSliceEvent{
+		"default/api-abc": {
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Addresses:   []string{"10.1.0.1", "10.1.0.2"},
+			Zones:       map[string]string{"10.1.0.1": "a"},
+			Ports:       []discoveryv1.EndpointPort{{Name: name("http"), Port: port(8080)}, {Name: name("dns"), Protocol: &udp, Port: port(5353)}},
+		},
+		// A slice part way through a rollout which changes the port
+		"default/api-def": {
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Addresses:   []string{"10.1.0.3"},
+			Ports:       []discoveryv1.EndpointPort{{Name: name("http"), Port: port(8081)}},
+		},
+		"default/api-ghi": {
+			AddressType: discoveryv1.AddressTypeIPv6,
+			Addresses:   []string{"fd01::1"},
+			Ports:       []discoveryv1.EndpointPort{{Name: name("http"), Port: port(8000)}},
+		},
+	}
+	pool := EndpointPoolDescription{
+		name:    "api",
+		service: "default/api",
+		ports: []EndpointPortMapping{
+			{Source: 80, PortName: "http", Protocol: corev1.ProtocolTCP, PortOptions: PortOptions{Algorithm: "random"}},
+			{Source: 53, PortName: "dns", Address: "10.0.0.10", Protocol: corev1.ProtocolUDP},
+			{Source: 443, PortName: "https", Protocol: corev1.ProtocolTCP},
+		},
+	}
+	cases := []struct {
+		name        string
+		addressType discoveryv1.AddressType
+		wantMembers map[string]string
+		wantPorts   []PortMapping
+	}{
+		{
+			name:        "all address types",
+			wantMembers: map[string]string{"10.1.0.1": "a", "10.1.0.2": "", "10.1.0.3": "", "fd01::1": ""},
+			wantPorts: []PortMapping{
+				{Source: 80, Dest: 8000, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 80, Last: 80}, PortOptions: PortOptions{Algorithm: "random"}},
+				{Source: 53, Dest: 5353, Address: "10.0.0.10", Protocol: corev1.ProtocolUDP, Range: public.PortRange{First: 53, Last: 53}},
+			},
+		},
+		{
+			name:        "one address type",
+			addressType: discoveryv1.AddressTypeIPv4,
+			wantMembers: map[string]string{"10.1.0.1": "a", "10.1.0.2": "", "10.1.0.3": ""},
+			wantPorts: []PortMapping{
+				{Source: 80, Dest: 8080, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 80, Last: 80}, PortOptions: PortOptions{Algorithm: "random"}},
+				{Source: 53, Dest: 5353, Address: "10.0.0.10", Protocol: corev1.ProtocolUDP, Range: public.PortRange{First: 53, Last: 53}},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pool.addressType = c.addressType
+			e := EndpointPoolWatcher{pool: pool}
+			if got := e.members(slices); !reflect.DeepEqual(got, c.wantMembers) {
+				t.Errorf("Got members %v, want %v", got, c.wantMembers)
+			}
+			if got := e.ports(slices); !reflect.DeepEqual(got, c.wantPorts) {
+				t.Errorf("Got ports %+v, want %+v", got, c.wantPorts)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// EndpointSliceWatcher tracks the ready endpoints of the services in a namespace. If labelSelector is empty, all endpoint slices which belong to a service are watched.
+type EndpointSliceWatcher struct {
+	kubernetesAPIs []kubernetes.Interface
+	namespace      string
+	labelSelector  string
+	// synced, if not nil, is called once the initial list has been sent
+	synced func()
+	// listOnly, if set, stops the watcher once the initial list has been sent, instead of watching for changes
+	listOnly bool
+}
+
+func endpointSliceKey(slice *discoveryv1.EndpointSlice) string {
+	return fmt.Sprintf("%s/%s", slice.Namespace, slice.Name)
+}
+
+// processEndpointSlice sends the ready endpoints of a slice, returning false if the watcher was stopped first
+func (e *EndpointSliceWatcher) processEndpointSlice(slice *discoveryv1.EndpointSlice, events chan<- EndpointSliceEvent, stop <-chan struct{}) bool {
+	serviceName, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok {
+		return true
+	}
+	nodes := make([]string, 0, len(slice.Endpoints))
+	addresses := make([]string, 0, len(slice.Endpoints))
+	zones := make(map[string]string)
+	for _, endpoint := range slice.Endpoints {
+		// A nil ready condition is to be interpreted as ready
+		if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+			continue
+		}
+		addresses = append(addresses, endpoint.Addresses...)
+		if endpoint.Zone != nil {
+			for _, address := range endpoint.Addresses {
+				zones[address] = *endpoint.Zone
+			}
+		}
+		if endpoint.NodeName == nil {
+			continue
+		}
+		nodes = append(nodes, *endpoint.NodeName)
+	}
+	event := EndpointSliceEvent{
+		Type:        watch.Modified,
+		Slice:       endpointSliceKey(slice),
+		Service:     fmt.Sprintf("%s/%s", slice.Namespace, serviceName),
+		Nodes:       nodes,
+		AddressType: slice.AddressType,
+		Addresses:   addresses,
+		Zones:       zones,
+		Ports:       slice.Ports,
+	}
+	select {
+	case events <- event:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+func (e *EndpointSliceWatcher) Run(ctx context.Context, events chan<- EndpointSliceEvent, stop <-chan struct{}) error {
+	watchEvents := make(chan watch.Event)
+	watchEnded := make(chan error, 1)
+	options := metav1.ListOptions{LabelSelector: e.labelSelector}
+	if options.LabelSelector == "" {
+		options.LabelSelector = discoveryv1.LabelServiceName
+	}
+	var initialList []discoveryv1.EndpointSlice
+	listed := false
+	for _, api := range e.kubernetesAPIs {
+		fmt.Printf("Getting initial list of endpoint slices: --namespace=%s --selector=%s\n", e.namespace, options.LabelSelector)
+		if !listed {
+			slices, err := api.DiscoveryV1().EndpointSlices(e.namespace).List(ctx, options)
+			if err != nil {
+				fmt.Printf("Listing endpoint slices failed: %v\n", err)
+				continue // Maybe another call will succeed?
+			}
+			initialList = slices.Items
+			listed = true
+		}
+		if e.listOnly {
+			break
+		}
+		watcher, err := api.DiscoveryV1().EndpointSlices(e.namespace).Watch(ctx, options)
+		if err != nil {
+			return err
+		}
+		defer watcher.Stop()
+		go forwardWatch("endpoint slices", watcher, sendWatchEvent(watchEvents, stop), watchEnded)
+	}
+
+	if !listed {
+		return fmt.Errorf("Did not get an initial list of endpoint slices")
+	}
+
+	for _, slice := range initialList {
+		if !e.processEndpointSlice(&slice, events, stop) {
+			return nil
+		}
+	}
+	notifySynced(e.synced)
+	if e.listOnly {
+		return nil
+	}
+
+	running := true
+
+	for running {
+		select {
+		case watchEvent := <-watchEvents:
+			slice, ok := watchEvent.Object.(*discoveryv1.EndpointSlice)
+			if !ok {
+				// TODO: Pass error
+				fmt.Printf("Unexpected watch event for endpoint slices: %#v\n", watchEvent)
+				continue
+			}
+			switch watchEvent.Type {
+			case watch.Added, watch.Modified:
+				running = e.processEndpointSlice(slice, events, stop)
+			case watch.Deleted:
+				select {
+				case events <- EndpointSliceEvent{Type: watch.Deleted, Slice: endpointSliceKey(slice)}:
+				case <-stop:
+					running = false
+				}
+			}
+		case err := <-watchEnded:
+			return err
+		case <-stop:
+			running = false
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProcessEndpointSlice(t *testing.T) {
+	ready := true
+	notReady := false
+	stringPtr := func(s string) *string { return &s }
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Namespace: "default", Name: "ingress-abc", Labels: map[string]string{discoveryv1.LabelServiceName: "ingress"}},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.1.0.1"}, NodeName: stringPtr("node-1"), Zone: stringPtr("a"), Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+			{Addresses: []string{"10.1.0.2"}, NodeName: stringPtr("node-2"), Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+			{Addresses: []string{"10.1.0.3"}, NodeName: stringPtr("node-3")},
+			{Addresses: []string{"10.1.0.4"}},
+		},
+	}
+	var e EndpointSliceWatcher
+	events := make(chan EndpointSliceEvent, 1)
+	if !e.processEndpointSlice(slice, events, nil) {
+		t.Fatal("Endpoint slice was not sent")
+	}
+	event := <-events
+	if event.Slice != "default/ingress-abc" || event.Service != "default/ingress" {
+		t.Errorf("Got slice %s of service %s, want default/ingress-abc of default/ingress", event.Slice, event.Service)
+	}
+	// Endpoints without a ready condition are ready, and those without a node have no node to forward to
+	if want := []string{"node-1", "node-3"}; !reflect.DeepEqual(event.Nodes, want) {
+		t.Errorf("Got nodes %v, want %v", event.Nodes, want)
+	}
+
+	if want := []string{"10.1.0.1", "10.1.0.3", "10.1.0.4"}; !reflect.DeepEqual(event.Addresses, want) {
+		t.Errorf("Got addresses %v, want %v", event.Addresses, want)
+	}
+
+	if want := map[string]string{"10.1.0.1": "a"}; !reflect.DeepEqual(event.Zones, want) {
+		t.Errorf("Got zones %v, want %v", event.Zones, want)
+	}
+
+	// A watcher which was stopped does not block on sending
+	stop := make(chan struct{})
+	close(stop)
+	if e.processEndpointSlice(slice, make(chan EndpointSliceEvent), stop) {
+		t.Error("Endpoint slice was sent after the watcher was stopped")
+	}
+
+	// A slice which does not belong to a service is ignored
+	slice.Labels = nil
+	if !e.processEndpointSlice(slice, events, nil) {
+		t.Fatal("Processing an endpoint slice without a service stopped")
+	}
+	if len(events) != 0 {
+		t.Errorf("Got an event for a slice without a service: %+v", <-events)
+	}
+}
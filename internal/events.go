@@ -1,11 +1,52 @@
 package internal
 
 import (
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/watch"
 )
 
+// NodeEvent indicates that a node has joined or changed within a pool (Modified), or has left it (Deleted)
 type NodeEvent struct {
-	Type    watch.EventType
-	Port    Port
-	Address string
+	Type      watch.EventType
+	Pool      string
+	Node      string
+	Addresses []string
+	// Zone is the topology zone of the node, if known
+	Zone string
+}
+
+// ServicePortsEvent indicates the ports discovered from a service for a pool. If the service was deleted, or no longer has any ports, Ports is empty
+type ServicePortsEvent struct {
+	Pool    string
+	Service string
+	Ports   []PortMapping
+}
+
+// EndpointSliceEvent indicates the ready endpoints in an EndpointSlice of a service, and the nodes they are on (Modified), or that the EndpointSlice was deleted (Deleted)
+type EndpointSliceEvent struct {
+	Type        watch.EventType
+	Slice       string
+	Service     string
+	Nodes       []string
+	AddressType discoveryv1.AddressType
+	Addresses   []string
+	// Zones maps each of the addresses to the zone of its endpoint, if known
+	Zones map[string]string
+	Ports []discoveryv1.EndpointPort
+}
+
+// TLSSecretEvent indicates that a TLS secret was written to disk (Modified), and whether either file changed, or that it no longer is (Deleted)
+type TLSSecretEvent struct {
+	Type     watch.EventType
+	Secret   string
+	CertPath string
+	KeyPath  string
+	Changed  bool
+}
+
+// IngressEvent indicates the rules of an ingress and the pool they are routed to. If the ingress was deleted, or is no longer handled, Rules is empty
+type IngressEvent struct {
+	Ingress string
+	Pool    string
+	Rules   []IngressRule
 }
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	TemplateFactories["exec"] = &ExecFactory{}
+}
+
+// ExecTemplater runs a command with the template variables as JSON on its stdin, and uses its stdout as the contents of the file
+type ExecTemplater struct {
+	command string
+	path    string
+}
+
+func (e *ExecTemplater) Path() string {
+	return e.path
+}
+
+func (e *ExecTemplater) Render(ctx context.Context, path string, vars interface{}) ([]byte, error) {
+	input, err := json.Marshal(vars)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", e.command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), "DOORMAN_PATH="+path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Kill the whole process group, as any children of the shell would otherwise keep stdout open, and the command from finishing
+			unix.Kill(-cmd.Process.Pid, unix.SIGKILL)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("Command for %s timed out", path)
+		}
+		return nil, fmt.Errorf("Command for %s failed: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	if stderr.Len() != 0 {
+		fmt.Printf("Command for %s: %s\n", path, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// ExecFactory uses the template as a shell command
+type ExecFactory struct{}
+
+func (e *ExecFactory) Parse(template string, partials map[string]string, path string) (Templater, error) {
+	if len(partials) != 0 {
+		return nil, fmt.Errorf("Partials can only be used with gotpl templates")
+	}
+	if strings.TrimSpace(template) == "" {
+		return nil, fmt.Errorf("A command is required")
+	}
+	return &ExecTemplater{command: template, path: path}, nil
+}
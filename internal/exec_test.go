@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecTemplater(t *testing.T) {
+	cases := []struct {
+		name    string
+		command string
+		timeout time.Duration
+		want    string
+		wantErr string
+	}{
+		{name: "stdin to stdout", command: "cat", want: `{"pool":"workers"}`},
+		{name: "rendered path", command: `echo "$DOORMAN_PATH"`, want: "/etc/doorman/workers.conf\n"},
+		{name: "stderr is logged", command: "echo warning >&2; echo ok", want: "ok\n"},
+		{name: "non-zero exit", command: "echo broken >&2; exit 1", wantErr: "broken"},
+		// The child keeps stdout open, so only killing the whole process group stops the command
+		{name: "timeout", command: "sleep 10 & wait", timeout: 100 * time.Millisecond, wantErr: "timed out"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			templater, err := (&ExecFactory{}).Parse(c.command, nil, "/etc/doorman/{{ .Pool }}.conf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if c.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, c.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			out, err := templater.Render(ctx, "/etc/doorman/workers.conf", map[string]string{"pool": "workers"})
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("Got error %v, want one containing %q", err, c.wantErr)
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Errorf("Command took %v to stop", time.Since(start))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != c.want {
+				t.Errorf("Got %q, want %q", out, c.want)
+			}
+		})
+	}
+}
+
+func TestExecFactoryParse(t *testing.T) {
+	if _, err := (&ExecFactory{}).Parse("  ", nil, "/tmp/a"); err == nil {
+		t.Error("Expected an error for an empty command")
+	}
+	if _, err := (&ExecFactory{}).Parse("cat", map[string]string{"a.tpl": "a"}, "/tmp/a"); err == nil {
+		t.Error("Expected an error for partials")
+	}
+}
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+// seLinuxXattr is the extended attribute which holds the SELinux context of a file
+const seLinuxXattr = "security.selinux"
+
+// fileOptions are the metadata of a written file
+type fileOptions struct {
+	// mode is the permissions of the file. If zero, a replaced file keeps its permissions, and a new file is 0644
+	mode os.FileMode
+	// uid and gid own the file. If -1, a replaced file keeps its owner or group, and a new file has doorman's
+	uid, gid int
+	// seLinuxContext is the SELinux context of the file. If empty, a replaced file keeps its context
+	seLinuxContext string
+	// createDirs creates the directory of the file if it does not exist, with dirMode
+	createDirs bool
+	dirMode    os.FileMode
+}
+
+func (o *fileOptions) FromConfig(cfg *public.Template) error {
+	*o = fileOptions{uid: -1, gid: -1, seLinuxContext: cfg.SELinuxContext, createDirs: cfg.CreateDirs, dirMode: 0755}
+	var err error
+	if cfg.Mode != "" {
+		if o.mode, err = parseMode(cfg.Mode); err != nil {
+			return err
+		}
+	}
+	if cfg.DirMode != "" {
+		if !cfg.CreateDirs {
+			return fmt.Errorf("dirMode can only be set with createDirs")
+		}
+		if o.dirMode, err = parseMode(cfg.DirMode); err != nil {
+			return err
+		}
+	}
+	if cfg.Owner != "" {
+		if o.uid, err = lookupOwner(cfg.Owner); err != nil {
+			return err
+		}
+	}
+	if cfg.Group != "" {
+		if o.gid, err = lookupGroup(cfg.Group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultFileOptions are the options of a file which is always written with the same permissions, and keeps its owner
+func defaultFileOptions(mode os.FileMode) fileOptions {
+	return fileOptions{mode: mode, uid: -1, gid: -1}
+}
+
+// parseMode parses octal permissions, e.g. 0640
+func parseMode(mode string) (os.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed == 0 || parsed > 0777 {
+		return 0, fmt.Errorf("Invalid mode %q, must be octal permissions, e.g. \"0644\"", mode)
+	}
+	return os.FileMode(parsed), nil
+}
+
+// lookupOwner returns the ID of a user name or ID, which must exist
+func lookupOwner(owner string) (int, error) {
+	var u *user.User
+	var err error
+	if _, convErr := strconv.Atoi(owner); convErr == nil {
+		u, err = user.LookupId(owner)
+	} else {
+		u, err = user.Lookup(owner)
+	}
+	switch err.(type) {
+	case user.UnknownUserError, user.UnknownUserIdError:
+		return 0, fmt.Errorf("No such user %s", owner)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup returns the ID of a group name or ID, which must exist
+func lookupGroup(group string) (int, error) {
+	var g *user.Group
+	var err error
+	if _, convErr := strconv.Atoi(group); convErr == nil {
+		g, err = user.LookupGroupId(group)
+	} else {
+		g, err = user.LookupGroup(group)
+	}
+	switch err.(type) {
+	case user.UnknownGroupError, user.UnknownGroupIdError:
+		return 0, fmt.Errorf("No such group %s", group)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// getSELinuxContext returns the SELinux context of a file, or an empty string if it has none, or the filesystem does not support them
+func getSELinuxContext(path string) (string, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Lgetxattr(path, seLinuxXattr, buf)
+		if err == unix.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+		if err == unix.ENODATA || err == unix.ENOTSUP {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(bytes.TrimRight(buf[:n], "\x00")), nil
+	}
+}
+
+// applyOptions sets the metadata of an open file, keeping that of the existing file it will replace, if any, for any which are not set
+func applyOptions(f *os.File, existing os.FileInfo, existingContext string, opts fileOptions) error {
+	mode, uid, gid, context := opts.mode, opts.uid, opts.gid, opts.seLinuxContext
+	if existing != nil {
+		if stat, ok := existing.Sys().(*syscall.Stat_t); ok {
+			if uid == -1 {
+				uid = int(stat.Uid)
+			}
+			if gid == -1 {
+				gid = int(stat.Gid)
+			}
+		}
+		if mode == 0 {
+			mode = existing.Mode().Perm()
+		}
+		if context == "" {
+			context = existingContext
+		}
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && ((uid != -1 && uint32(uid) != stat.Uid) || (gid != -1 && uint32(gid) != stat.Gid)) {
+		// Keeping the owner of the existing file is only possible as root, so a new owner is only an error if it was configured
+		if err := f.Chown(uid, gid); err != nil && (opts.uid != -1 || opts.gid != -1 || !errors.Is(err, unix.EPERM)) {
+			return err
+		}
+	}
+	// Permissions are set after ownership, as changing the owner clears the setuid and setgid bits
+	if mode != info.Mode().Perm() {
+		if err := f.Chmod(mode); err != nil {
+			return err
+		}
+	}
+	if context == "" {
+		return nil
+	}
+	current, err := getSELinuxContext(f.Name())
+	if err != nil || current == context {
+		return err
+	}
+	if err := unix.Fsetxattr(int(f.Fd()), seLinuxXattr, []byte(context), 0); err != nil {
+		if opts.seLinuxContext == "" && err == unix.ENOTSUP {
+			// The context of the existing file could not be kept, e.g. because SELinux is not enabled
+			return nil
+		}
+		return fmt.Errorf("Setting SELinux context of %s to %s failed: %v", f.Name(), context, err)
+	}
+	return nil
+}
+
+// writeFileIfChanged writes data to a file if its contents differ, by writing a temporary file in the same directory and renaming it,
+// so that readers never see a partially written file. Returns true if the file was written.
+func writeFileIfChanged(path string, data []byte, mode os.FileMode) (bool, error) {
+	return writeFile(path, data, defaultFileOptions(mode))
+}
+
+// writeFile writes data to a file with options if its contents differ, the same as writeFileIfChanged.
+// If they do not differ, but its metadata does, the metadata is updated in place, which does not count as being written.
+func writeFile(path string, data []byte, opts fileOptions) (bool, error) {
+	staged, err := stageFile(path, data, opts)
+	if err != nil || staged == nil {
+		return false, err
+	}
+	if err := staged.commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// stagedFile is the new contents of a file, written to a temporary file in the same directory which has not yet replaced it
+type stagedFile struct {
+	path string
+	temp string
+}
+
+// stageFile writes data to a temporary file with options if the contents of the file at path differ, which commit then renames over it.
+// If they do not differ, but its metadata does, the metadata is updated in place, and nil is returned.
+func stageFile(path string, data []byte, opts fileOptions) (*stagedFile, error) {
+	if opts.createDirs {
+		if err := os.MkdirAll(filepath.Dir(path), opts.dirMode); err != nil {
+			return nil, err
+		}
+	}
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var info os.FileInfo
+	existingContext := ""
+	if err == nil {
+		if info, err = os.Stat(path); err != nil {
+			return nil, err
+		}
+		if existingContext, err = getSELinuxContext(path); err != nil {
+			return nil, err
+		}
+	}
+	if info != nil && bytes.Equal(existing, data) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return nil, applyOptions(f, info, existingContext, opts)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = applyOptions(f, info, existingContext, opts)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &stagedFile{path: path, temp: f.Name()}, nil
+}
+
+// commit replaces the file with its new contents, removing them instead if that fails
+func (s *stagedFile) commit() error {
+	if err := os.Rename(s.temp, s.path); err != nil {
+		s.discard()
+		return err
+	}
+	return nil
+}
+
+// discard removes the new contents without replacing the file
+func (s *stagedFile) discard() {
+	os.Remove(s.temp)
+}
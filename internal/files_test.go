@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestParseMode(t *testing.T) {
+	cases := []struct {
+		mode    string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{mode: "0644", want: 0644},
+		{mode: "640", want: 0640},
+		{mode: "0", wantErr: true},
+		{mode: "0888", wantErr: true},
+		{mode: "01777", wantErr: true},
+		{mode: "rw-r--r--", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.mode, func(t *testing.T) {
+			got, err := parseMode(c.mode)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLookupOwnerAndGroup(t *testing.T) {
+	cases := []struct {
+		name    string
+		lookup  func(string) (int, error)
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{name: "user name", lookup: lookupOwner, value: "root", want: 0},
+		{name: "user ID", lookup: lookupOwner, value: "0", want: 0},
+		{name: "unknown user name", lookup: lookupOwner, value: "doorman-no-such-user", wantErr: true},
+		{name: "unknown user ID", lookup: lookupOwner, value: "2147483000", wantErr: true},
+		{name: "group name", lookup: lookupGroup, value: "root", want: 0},
+		{name: "group ID", lookup: lookupGroup, value: "0", want: 0},
+		{name: "unknown group name", lookup: lookupGroup, value: "doorman-no-such-group", wantErr: true},
+		{name: "unknown group ID", lookup: lookupGroup, value: "2147483000", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.lookup(c.value)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("Got %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFileOptionsFromConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     public.Template
+		want    fileOptions
+		wantErr bool
+	}{
+		{name: "defaults", want: fileOptions{uid: -1, gid: -1, dirMode: 0755}},
+		{name: "all options", cfg: public.Template{Mode: "0640", Owner: "0", Group: "root", CreateDirs: true, DirMode: "0750"}, want: fileOptions{mode: 0640, uid: 0, gid: 0, createDirs: true, dirMode: 0750}},
+		{name: "dirMode without createDirs", cfg: public.Template{DirMode: "0750"}, wantErr: true},
+		{name: "invalid mode", cfg: public.Template{Mode: "644x"}, wantErr: true},
+		{name: "unknown owner", cfg: public.Template{Owner: "2147483000"}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got fileOptions
+			err := got.FromConfig(&c.cfg)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("Got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	mode := func(path string) os.FileMode {
+		t.Helper()
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+
+	// A new file is 0644, unless a mode is set
+	path := filepath.Join(dir, "doorman.conf")
+	if changed, err := writeFile(path, []byte("a\n"), fileOptions{uid: -1, gid: -1}); err != nil || !changed {
+		t.Fatalf("Got %v, %v from writing a new file", changed, err)
+	}
+	if got := mode(path); got != 0644 {
+		t.Errorf("Got mode %v for a new file, want 0644", got)
+	}
+	if changed, err := writeFile(path, []byte("a\n"), fileOptions{uid: -1, gid: -1}); err != nil || changed {
+		t.Errorf("Got %v, %v from writing the same data", changed, err)
+	}
+
+	// A replaced file keeps its mode, unless one is set
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeFile(path, []byte("b\n"), fileOptions{uid: -1, gid: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mode(path); got != 0600 {
+		t.Errorf("Got mode %v for a replaced file, want 0600", got)
+	}
+	if _, err := writeFile(path, []byte("c\n"), fileOptions{mode: 0640, uid: -1, gid: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mode(path); got != 0640 {
+		t.Errorf("Got mode %v, want 0640", got)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "c\n" {
+		t.Errorf("Got %q, %v, want c", data, err)
+	}
+
+	// Missing directories are only created if enabled
+	nested := filepath.Join(dir, "conf.d", "stream", "doorman.conf")
+	if _, err := writeFile(nested, []byte("a\n"), fileOptions{uid: -1, gid: -1}); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+	if _, err := writeFile(nested, []byte("a\n"), fileOptions{uid: -1, gid: -1, createDirs: true, dirMode: 0750}); err != nil {
+		t.Fatal(err)
+	}
+	if got := mode(filepath.Dir(nested)); got != 0750 {
+		t.Errorf("Got mode %v for a created directory, want 0750", got)
+	}
+}
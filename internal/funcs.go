@@ -0,0 +1,489 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	gotpl "text/template"
+	"time"
+	"unicode"
+
+	"sigs.k8s.io/yaml"
+)
+
+// TemplateFuncs are the functions available to every gotpl template.
+// Where a function has the same name as one from Sprig, it takes the same arguments in the same order, so that the last argument can be piped into it.
+var TemplateFuncs = gotpl.FuncMap{
+	// Strings
+	"trim":       strings.TrimSpace,
+	"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"title":      title,
+	"replace":    func(old, replacement, s string) string { return strings.ReplaceAll(s, old, replacement) },
+	"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+	"trunc":      trunc,
+	"indent":     indent,
+	"nindent":    func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+	"quote":      quote,
+	"squote":     squote,
+	"cat":        cat,
+	"splitList":  func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       join,
+	"toString":   toString,
+	"atoi":       strconv.Atoi,
+
+	// Defaults and conditions
+	"default":  defaultValue,
+	"empty":    empty,
+	"coalesce": coalesce,
+	"ternary":  ternary,
+
+	// Lists and dicts
+	"list":      func(items ...interface{}) []interface{} { return items },
+	"first":     first,
+	"last":      last,
+	"has":       has,
+	"uniq":      uniq,
+	"sortAlpha": sortAlpha,
+	"dict":      dict,
+	"keys":      keys,
+
+	// Math
+	"add": add,
+	"sub": func(a, b interface{}) int64 { return toInt64(a) - toInt64(b) },
+	"mul": mul,
+	"div": func(a, b interface{}) int64 { return toInt64(a) / toInt64(b) },
+	"mod": func(a, b interface{}) int64 { return toInt64(a) % toInt64(b) },
+	"max": max,
+	"min": min,
+
+	// Encodings and hashes
+	"b64enc":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":       b64dec,
+	"sha1sum":      func(s string) string { sum := sha1.Sum([]byte(s)); return hex.EncodeToString(sum[:]) },
+	"sha256sum":    func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+	"toJson":       toJSON,
+	"toPrettyJson": toPrettyJSON,
+	"toYaml":       toYAML,
+
+	// Durations
+	"ms": ms,
+
+	// Addresses
+	"hostPort":   hostPort,
+	"ipFamily":   ipFamily,
+	"sortByNode": sortByNode,
+
+	// Load balancing
+	"lbAlgorithm": lbAlgorithm,
+}
+
+// toList converts a slice or array to a list of its items, or returns an error for anything else
+func toList(list interface{}) ([]interface{}, error) {
+	if list == nil {
+		return nil, nil
+	}
+	value := reflect.ValueOf(list)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = value.Index(i).Interface()
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("Expected a list, got %T", list)
+	}
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toInt64(v interface{}) int64 {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return int64(value.Float())
+	case reflect.String:
+		i, _ := strconv.ParseInt(value.String(), 10, 64)
+		return i
+	default:
+		return 0
+	}
+}
+
+// ms formats a duration as whole milliseconds, rounded up, e.g. 1.5s as 1500ms, which nginx and haproxy accept, unlike the default format of a duration
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%dms", (d+time.Millisecond-1)/time.Millisecond)
+}
+
+// title upper cases the first letter of each word, which are separated by spaces
+func title(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		if i == 0 || unicode.IsSpace(runes[i-1]) {
+			runes[i] = unicode.ToTitle(r)
+		}
+	}
+	return string(runes)
+}
+
+func trunc(length int, s string) string {
+	if length < 0 && len(s)+length > 0 {
+		return s[len(s)+length:]
+	}
+	if length >= 0 && len(s) > length {
+		return s[:length]
+	}
+	return s
+}
+
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func quote(items ...interface{}) string {
+	quoted := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			quoted = append(quoted, strconv.Quote(toString(item)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func squote(items ...interface{}) string {
+	quoted := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			quoted = append(quoted, "'"+toString(item)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func cat(items ...interface{}) string {
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if item != nil {
+			strs = append(strs, toString(item))
+		}
+	}
+	return strings.Join(strs, " ")
+}
+
+func join(sep string, list interface{}) (string, error) {
+	items, err := toList(list)
+	if err != nil {
+		return "", err
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i] = toString(item)
+	}
+	return strings.Join(strs, sep), nil
+}
+
+// empty returns true if a value is nil or the zero value of its type, or an empty list, map, or string
+func empty(v interface{}) bool {
+	value := reflect.ValueOf(v)
+	if !value.IsValid() {
+		return true
+	}
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return value.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	default:
+		return value.IsZero()
+	}
+}
+
+func defaultValue(fallback interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || empty(given[0]) {
+		return fallback
+	}
+	return given[0]
+}
+
+func coalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+func ternary(ifTrue, ifFalse interface{}, condition bool) interface{} {
+	if condition {
+		return ifTrue
+	}
+	return ifFalse
+}
+
+func first(list interface{}) (interface{}, error) {
+	items, err := toList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+func last(list interface{}) (interface{}, error) {
+	items, err := toList(list)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[len(items)-1], nil
+}
+
+func has(needle interface{}, list interface{}) (bool, error) {
+	items, err := toList(list)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range items {
+		if reflect.DeepEqual(item, needle) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// uniq returns the items of a list without duplicates, keeping the first of each
+func uniq(list interface{}) ([]interface{}, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	unique := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		seen := false
+		for _, existing := range unique {
+			if reflect.DeepEqual(item, existing) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			unique = append(unique, item)
+		}
+	}
+	return unique, nil
+}
+
+func sortAlpha(list interface{}) ([]string, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i] = toString(item)
+	}
+	sort.Strings(strs)
+	return strs, nil
+}
+
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("Expected pairs of keys and values, got %d arguments", len(pairs))
+	}
+	d := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		d[toString(pairs[i])] = pairs[i+1]
+	}
+	return d, nil
+}
+
+// keys returns the sorted keys of a map
+func keys(m interface{}) ([]string, error) {
+	value := reflect.ValueOf(m)
+	if value.Kind() != reflect.Map {
+		return nil, fmt.Errorf("Expected a map, got %T", m)
+	}
+	strs := make([]string, 0, value.Len())
+	for _, key := range value.MapKeys() {
+		strs = append(strs, toString(key.Interface()))
+	}
+	sort.Strings(strs)
+	return strs, nil
+}
+
+func add(values ...interface{}) int64 {
+	var result int64
+	for _, v := range values {
+		result += toInt64(v)
+	}
+	return result
+}
+
+func mul(a interface{}, rest ...interface{}) int64 {
+	result := toInt64(a)
+	for _, v := range rest {
+		result *= toInt64(v)
+	}
+	return result
+}
+
+func max(a interface{}, rest ...interface{}) int64 {
+	result := toInt64(a)
+	for _, v := range rest {
+		if i := toInt64(v); i > result {
+			result = i
+		}
+	}
+	return result
+}
+
+func min(a interface{}, rest ...interface{}) int64 {
+	result := toInt64(a)
+	for _, v := range rest {
+		if i := toInt64(v); i < result {
+			result = i
+		}
+	}
+	return result
+}
+
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func toPrettyJSON(v interface{}) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func toYAML(v interface{}) (string, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// hostPort joins an address and a port, putting IPv6 addresses in brackets
+func hostPort(host string, port interface{}) string {
+	return net.JoinHostPort(host, toString(port))
+}
+
+// ipFamily returns IPv4 or IPv6 for an IP address, or an empty string for anything else, such as a hostname
+func ipFamily(address string) string {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "IPv4"
+	default:
+		return "IPv6"
+	}
+}
+
+// nodeLess orders addresses by IPv4 addresses, then IPv6 addresses, both by value, then hostnames with runs of digits compared by value, e.g. node-2 before node-10
+func nodeLess(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA != nil || ipB != nil {
+		if ipA == nil || ipB == nil {
+			return ipA != nil
+		}
+		if (ipA.To4() == nil) != (ipB.To4() == nil) {
+			return ipA.To4() != nil
+		}
+		return string(ipA.To16()) < string(ipB.To16())
+	}
+	for a != "" && b != "" {
+		if unicode.IsDigit(rune(a[0])) && unicode.IsDigit(rune(b[0])) {
+			numA, restA := splitDigits(a)
+			numB, restB := splitDigits(b)
+			trimmedA, trimmedB := strings.TrimLeft(numA, "0"), strings.TrimLeft(numB, "0")
+			if len(trimmedA) != len(trimmedB) {
+				return len(trimmedA) < len(trimmedB)
+			}
+			if trimmedA != trimmedB {
+				return trimmedA < trimmedB
+			}
+			a, b = restA, restB
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// splitDigits splits a string after its leading digits
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && unicode.IsDigit(rune(s[i])) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// sortByNode sorts a list of node addresses in the order nodes are usually numbered, so that e.g. 10.0.0.2 comes before 10.0.0.10
+func sortByNode(list interface{}) ([]string, error) {
+	items, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	strs := make([]string, len(items))
+	for i, item := range items {
+		strs[i] = toString(item)
+	}
+	sort.SliceStable(strs, func(i, j int) bool {
+		return nodeLess(strs[i], strs[j])
+	})
+	return strs, nil
+}
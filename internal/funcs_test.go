@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+	gotpl "text/template"
+	"time"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		vars     interface{}
+		want     string
+		wantErr  bool
+	}{
+		{name: "trim", template: `{{ trim "  a b  " }}`, want: "a b"},
+		{name: "trimPrefix piped", template: `{{ "doorman_tcp" | trimPrefix "doorman_" }}`, want: "tcp"},
+		{name: "title", template: `{{ title "hello  wide\tworld" }}`, want: "Hello  Wide\tWorld"},
+		{name: "replace", template: `{{ "10.0.0.1" | replace "." "_" }}`, want: "10_0_0_1"},
+		{name: "trunc", template: `{{ trunc 3 "abcdef" }} {{ trunc -2 "abcdef" }}`, want: "abc ef"},
+		{name: "indent", template: `{{ indent 2 "a\nb" }}`, want: "  a\n  b"},
+		{name: "quote", template: `{{ quote "a" 1 }}`, want: `"a" "1"`},
+		{name: "join", template: `{{ join "," (list "a" 1 true) }}`, want: "a,1,true"},
+		{name: "join of a non-list", template: `{{ join "," 1 }}`, wantErr: true},
+		{name: "atoi", template: `{{ add (atoi "41") 1 }}`, want: "42"},
+		{name: "atoi of a non-number", template: `{{ atoi "forty" }}`, wantErr: true},
+		{name: "default of empty", template: `{{ default "leastConn" "" }}`, want: "leastConn"},
+		{name: "default of set", template: `{{ "random" | default "leastConn" }}`, want: "random"},
+		{name: "coalesce", template: `{{ coalesce "" 0 "a" "b" }}`, want: "a"},
+		{name: "ternary", template: `{{ ternary "yes" "no" true }} {{ ternary "yes" "no" false }}`, want: "yes no"},
+		{name: "first and last", template: `{{ first (list 1 2 3) }} {{ last (list 1 2 3) }}`, want: "1 3"},
+		{name: "first of empty", template: `{{ first (list) }}`, want: "<no value>"},
+		{name: "has", template: `{{ has "b" (list "a" "b") }} {{ has "c" (list "a" "b") }}`, want: "true false"},
+		{name: "uniq and sortAlpha", template: `{{ list "b" "a" "b" | uniq | sortAlpha }}`, want: "[a b]"},
+		{name: "dict and keys", template: `{{ keys (dict "b" 1 "a" 2) }}`, want: "[a b]"},
+		{name: "dict with odd arguments", template: `{{ dict "a" }}`, wantErr: true},
+		{name: "math", template: `{{ add 1 2 }} {{ add 1 2 3 }} {{ sub 1 2 }} {{ mul 2 3 }} {{ mul 2 3 4 }} {{ div 7 2 }} {{ mod 7 2 }} {{ max 1 3 2 }} {{ min 3 1 2 }}`, want: "3 6 -1 6 24 3 1 3 1"},
+		{name: "b64", template: `{{ b64enc "doorman" }} {{ b64dec "ZG9vcm1hbg==" }}`, want: "ZG9vcm1hbg== doorman"},
+		{name: "b64dec of invalid", template: `{{ b64dec "!" }}`, wantErr: true},
+		{name: "toJson", template: `{{ toJson (dict "a" (list 1)) }}`, want: `{"a":[1]}`},
+		{name: "toYaml", template: `{{ toYaml (dict "a" 1) }}`, want: "a: 1"},
+		{name: "ms", template: `{{ ms .a }} {{ ms .b }} {{ ms .c }}`, vars: map[string]time.Duration{"a": 1500 * time.Millisecond, "b": 1500 * time.Microsecond, "c": 0}, want: "1500ms 2ms 0ms"},
+		{name: "hostPort", template: `{{ hostPort "10.0.0.1" 80 }} {{ hostPort "fd00::1" "443" }} {{ hostPort "node-1" 22 }}`, want: "10.0.0.1:80 [fd00::1]:443 node-1:22"},
+		{name: "ipFamily", template: `{{ ipFamily "10.0.0.1" }} {{ ipFamily "fd00::1" }} {{ ipFamily "node-1" | quote }}`, want: `IPv4 IPv6 ""`},
+		{name: "sortByNode", template: `{{ sortByNode (list "node-10" "fd00::1" "10.0.0.10" "node-2" "10.0.0.2") }}`, want: "[10.0.0.2 10.0.0.10 fd00::1 node-2 node-10]"},
+		{name: "lbAlgorithm", template: `{{ lbAlgorithm "haproxy" "leastConn" }} {{ lbAlgorithm "keepalived" "sourceHash" }} {{ lbAlgorithm "nginx" "roundRobin" | quote }}`, want: `leastconn sh ""`},
+		{name: "lbAlgorithm of an unrecognized algorithm", template: `{{ lbAlgorithm "nginx" "least_conn" }}`, wantErr: true},
+		{name: "lbAlgorithm of an unsupported algorithm", template: `{{ lbAlgorithm "envoy" "sourceHash" }}`, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tpl, err := gotpl.New(c.name).Funcs(TemplateFuncs).Parse(c.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			err = tpl.Execute(&buf, c.vars)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %q", buf.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != c.want {
+				t.Errorf("Got %q, want %q", buf.String(), c.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package internal
 
 import (
-	"os"
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
 	gotpl "text/template"
 )
 
@@ -15,23 +18,39 @@ type GoTplTemplater struct {
 	path     string
 }
 
-func (g *GoTplTemplater) Template(vars interface{}) error {
-	f, err := os.Create(g.path)
-	if err != nil {
-		return err
+func (g *GoTplTemplater) Path() string {
+	return g.path
+}
+
+func (g *GoTplTemplater) Render(ctx context.Context, path string, vars interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := g.template.Execute(&buf, vars); err != nil {
+		return nil, err
 	}
-	defer f.Close()
-	return g.template.Execute(f, vars)
+	return buf.Bytes(), nil
 }
 
 type GoTplFactory struct{}
 
-func (g *GoTplFactory) Parse(template string, path string) (Templater, error) {
-	tpl := GoTplTemplater{path: path, template: gotpl.New(path)}
+func (g *GoTplFactory) Parse(template string, partials map[string]string, path string) (Templater, error) {
+	if template == "" {
+		return nil, fmt.Errorf("One of template, templateFile, or preset is required")
+	}
+	tpl := GoTplTemplater{path: path, template: gotpl.New(path).Funcs(TemplateFuncs)}
 
 	_, err := tpl.template.Parse(template)
 	if err != nil {
 		return nil, err
 	}
+	names := make([]string, 0, len(partials))
+	for name := range partials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := tpl.template.New(name).Parse(partials[name]); err != nil {
+			return nil, err
+		}
+	}
 	return &tpl, err
 }
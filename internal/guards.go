@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+// DefaultRemovalWindow is the period over which removed members are counted if not configured
+const DefaultRemovalWindow = time.Minute
+
+type GuardDescription struct {
+	minMembers          int
+	maxRemovedFraction  float64
+	removalWindow       time.Duration
+	stabilizationPeriod time.Duration
+}
+
+func (g *GuardDescription) FromConfig(cfg *public.GuardConfigFile) error {
+	if cfg.MinMembers < 0 {
+		return fmt.Errorf("minMembers cannot be negative")
+	}
+	if cfg.MaxRemovedFraction < 0 || cfg.MaxRemovedFraction > 1 {
+		return fmt.Errorf("maxRemovedFraction must be between 0 and 1")
+	}
+	g.minMembers = cfg.MinMembers
+	g.maxRemovedFraction = cfg.MaxRemovedFraction
+	g.removalWindow = DefaultRemovalWindow
+	if cfg.RemovalWindow != nil {
+		g.removalWindow = cfg.RemovalWindow.Duration
+	}
+	if cfg.StabilizationPeriod != nil {
+		g.stabilizationPeriod = cfg.StabilizationPeriod.Duration
+	}
+	return nil
+}
+
+// check returns a description of the limit a change in membership exceeds, or empty if it is within the limits.
+// baseline is the rendered membership at the start of the removal window, and is nil if nothing has been rendered yet.
+func (g *GuardDescription) check(baseline, members map[string]struct{}) string {
+	if len(members) < g.minMembers {
+		return fmt.Sprintf("%d members is fewer than the minimum of %d", len(members), g.minMembers)
+	}
+	if g.maxRemovedFraction == 0 || len(baseline) == 0 {
+		return ""
+	}
+	removed := 0
+	for member := range baseline {
+		if _, ok := members[member]; !ok {
+			removed++
+		}
+	}
+	fraction := float64(removed) / float64(len(baseline))
+	if fraction > g.maxRemovedFraction {
+		return fmt.Sprintf("%d of %d members would be removed within %v, which is more than the maximum fraction of %v", removed, len(baseline), g.removalWindow, g.maxRemovedFraction)
+	}
+	return ""
+}
+
+// trippedGuard is the membership of a pool which exceeded its guard's limits, and when that membership was first seen
+type trippedGuard struct {
+	members map[string]struct{}
+	since   time.Time
+}
+
+// baseline is the rendered membership of a pool since the start of its removal window
+type baseline struct {
+	members map[string]struct{}
+	since   time.Time
+}
+
+// guardState tracks the rendered membership of each pool, and the pools whose guards are currently tripped
+type guardState struct {
+	guards    map[string]GuardDescription
+	baselines map[string]baseline
+	tripped   map[string]trippedGuard
+}
+
+func newGuardState(guards map[string]GuardDescription) *guardState {
+	return &guardState{guards: guards, baselines: make(map[string]baseline), tripped: make(map[string]trippedGuard)}
+}
+
+// members returns the names of the members of each pool
+func (c *clusterState) members() map[string]map[string]struct{} {
+	members := make(map[string]map[string]struct{}, len(c.pools))
+	for pool, state := range c.pools {
+		members[pool] = make(map[string]struct{}, len(state.nodes))
+		for node := range state.nodes {
+			members[pool][node] = struct{}{}
+		}
+	}
+	return members
+}
+
+// check returns the problems with the current membership of each pool, sorted by pool, and the time at which the earliest
+// stabilization period will end, which is zero if there is none. A tripped guard is cleared once its pool's membership has not
+// changed for its stabilization period.
+func (g *guardState) check(members map[string]map[string]struct{}, now time.Time) ([]string, time.Time) {
+	problems := make([]string, 0)
+	var next time.Time
+	for pool, guard := range g.guards {
+		problem := guard.check(g.baselines[pool].members, members[pool])
+		if problem == "" {
+			delete(g.tripped, pool)
+			continue
+		}
+		tripped, ok := g.tripped[pool]
+		if !ok || !reflect.DeepEqual(tripped.members, members[pool]) {
+			tripped = trippedGuard{members: members[pool], since: now}
+			g.tripped[pool] = tripped
+		}
+		if guard.stabilizationPeriod != 0 {
+			stable := tripped.since.Add(guard.stabilizationPeriod)
+			if !now.Before(stable) {
+				fmt.Printf("Membership of pool %s has been stable for %v, accepting it: %s\n", pool, guard.stabilizationPeriod, problem)
+				continue
+			}
+			if next.IsZero() || stable.Before(next) {
+				next = stable
+			}
+		}
+		problems = append(problems, fmt.Sprintf("Pool %s: %s", pool, problem))
+	}
+	sort.Strings(problems)
+	return problems, next
+}
+
+// apply records the membership of each pool which was rendered, starting a new removal window for pools whose window has ended.
+// The window of a pool also ends when its membership is rendered despite exceeding a limit, so that the override or stabilized membership is the new baseline.
+func (g *guardState) apply(members map[string]map[string]struct{}, now time.Time) {
+	for pool, guard := range g.guards {
+		current, ok := g.baselines[pool]
+		_, tripped := g.tripped[pool]
+		if !ok || tripped || now.Sub(current.since) >= guard.removalWindow {
+			g.baselines[pool] = baseline{members: members[pool], since: now}
+			continue
+		}
+		// Members added during the window count towards it, so that they are guarded as well
+		for member := range members[pool] {
+			current.members[member] = struct{}{}
+		}
+	}
+	g.tripped = make(map[string]trippedGuard)
+}
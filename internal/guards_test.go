@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func memberSet(names ...string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return set
+}
+
+func TestGuardDescriptionCheck(t *testing.T) {
+	cases := []struct {
+		name        string
+		guard       GuardDescription
+		baseline    map[string]struct{}
+		members     map[string]struct{}
+		wantProblem bool
+	}{
+		{name: "no limits", baseline: memberSet("a", "b"), members: memberSet()},
+		{name: "enough members", guard: GuardDescription{minMembers: 2}, members: memberSet("a", "b")},
+		{name: "too few members", guard: GuardDescription{minMembers: 2}, members: memberSet("a"), wantProblem: true},
+		{name: "nothing rendered yet", guard: GuardDescription{maxRemovedFraction: 0.5}, members: memberSet("a")},
+		{name: "removed within the limit", guard: GuardDescription{maxRemovedFraction: 0.5}, baseline: memberSet("a", "b", "c", "d"), members: memberSet("a", "b", "e")},
+		{name: "removed over the limit", guard: GuardDescription{maxRemovedFraction: 0.5}, baseline: memberSet("a", "b", "c", "d"), members: memberSet("a", "e", "f", "g"), wantProblem: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			problem := c.guard.check(c.baseline, c.members)
+			if c.wantProblem && problem == "" {
+				t.Error("Expected a problem")
+			}
+			if !c.wantProblem && problem != "" {
+				t.Errorf("Got problem %q", problem)
+			}
+		})
+	}
+}
+
+func TestGuardState(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := newGuardState(map[string]GuardDescription{
+		"workers": {maxRemovedFraction: 0.5, removalWindow: time.Minute},
+		"cp":      {minMembers: 2, stabilizationPeriod: 30 * time.Second},
+	})
+	expectProblems := func(pools map[string]map[string]struct{}, now time.Time, want int, wantNext time.Time) {
+		t.Helper()
+		problems, next := g.check(pools, now)
+		if len(problems) != want {
+			t.Errorf("Got problems %v, want %d", problems, want)
+		}
+		if !next.Equal(wantNext) {
+			t.Errorf("Got next check at %v, want %v", next, wantNext)
+		}
+	}
+
+	initial := map[string]map[string]struct{}{"workers": memberSet("a", "b", "c", "d"), "cp": memberSet("x", "y")}
+	expectProblems(initial, start, 0, time.Time{})
+	g.apply(initial, start)
+
+	// Members leaving one at a time are counted against the start of the window
+	expectProblems(map[string]map[string]struct{}{"workers": memberSet("a", "b", "c"), "cp": memberSet("x", "y")}, start.Add(10*time.Second), 0, time.Time{})
+	g.apply(map[string]map[string]struct{}{"workers": memberSet("a", "b", "c"), "cp": memberSet("x", "y")}, start.Add(10*time.Second))
+	expectProblems(map[string]map[string]struct{}{"workers": memberSet("a"), "cp": memberSet("x", "y")}, start.Add(20*time.Second), 1, time.Time{})
+
+	// Once the window has ended, the rendered membership is the new baseline
+	g.apply(map[string]map[string]struct{}{"workers": memberSet("a", "b", "c"), "cp": memberSet("x", "y")}, start.Add(2*time.Minute))
+	expectProblems(map[string]map[string]struct{}{"workers": memberSet("a", "b"), "cp": memberSet("x", "y")}, start.Add(2*time.Minute+time.Second), 0, time.Time{})
+
+	// A guard with a stabilization period accepts the membership once it has not changed for that period
+	tooFew := map[string]map[string]struct{}{"workers": memberSet("a", "b", "c"), "cp": memberSet("x")}
+	now := start.Add(3 * time.Minute)
+	expectProblems(tooFew, now, 1, now.Add(30*time.Second))
+	expectProblems(tooFew, now.Add(10*time.Second), 1, now.Add(30*time.Second))
+	expectProblems(tooFew, now.Add(30*time.Second), 0, time.Time{})
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HealthEndpoint serves the health of doorman over HTTP. It is healthy unless a problem has been reported.
+type HealthEndpoint struct {
+	port int
+	lock sync.Mutex
+	// problems are the reported problems from each source
+	problems map[string][]string
+}
+
+// SetProblems replaces the problems reported by a source, an empty list is healthy
+func (h *HealthEndpoint) SetProblems(source string, problems []string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.problems == nil {
+		h.problems = make(map[string][]string)
+	}
+	if len(problems) == 0 {
+		delete(h.problems, source)
+		return
+	}
+	h.problems[source] = problems
+}
+
+func (h *HealthEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	sources := make([]string, 0, len(h.problems))
+	for source := range h.problems {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	problems := make([]string, 0, len(sources))
+	for _, source := range sources {
+		problems = append(problems, h.problems[source]...)
+	}
+	h.lock.Unlock()
+	if len(problems) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *HealthEndpoint) Run(ctx context.Context, stop <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", h)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", h.port), Handler: mux}
+	go func() {
+		<-stop
+		server.Shutdown(ctx)
+	}()
+	fmt.Printf("Serving health endpoint on %s\n", server.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strconv"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+// ingressClassAnnotation is the deprecated annotation for the class of an Ingress, which is still widely used
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+type IngressesDescription struct {
+	pool             string
+	ingressClassName string
+	namespace        string
+	labelSelector    string
+}
+
+func (i *IngressesDescription) FromConfig(cfg *public.IngressesConfigFile) error {
+	if cfg.Pool == "" {
+		return fmt.Errorf("A pool is required")
+	}
+	i.pool = cfg.Pool
+	i.ingressClassName = cfg.IngressClassName
+	i.namespace = cfg.Namespace
+	if cfg.Labels != nil {
+		selector, err := metav1.LabelSelectorAsSelector(cfg.Labels)
+		if err != nil {
+			return err
+		}
+		i.labelSelector = selector.String()
+	}
+	return nil
+}
+
+// handles returns true if an ingress is of the configured class
+func (i *IngressesDescription) handles(ingress *networkingv1.Ingress) bool {
+	if i.ingressClassName == "" {
+		return true
+	}
+	if ingress.Spec.IngressClassName != nil {
+		return *ingress.Spec.IngressClassName == i.ingressClassName
+	}
+	return ingress.Annotations[ingressClassAnnotation] == i.ingressClassName
+}
+
+// IngressRule is the paths and TLS secret of a single host of an Ingress
+type IngressRule struct {
+	Host string
+	// TLSSecret is the namespace/name of the secret with the certificate for the host, or empty if the host does not use TLS
+	TLSSecret string
+	Paths     []PathVars
+}
+
+func ingressKey(ingress *networkingv1.Ingress) string {
+	return fmt.Sprintf("%s/%s", ingress.Namespace, ingress.Name)
+}
+
+// RulesFromIngress returns the rules of an ingress, merging rules for the same host
+func RulesFromIngress(ingress *networkingv1.Ingress) []IngressRule {
+	key := ingressKey(ingress)
+	tlsSecrets := make(map[string]string)
+	for _, tls := range ingress.Spec.TLS {
+		if tls.SecretName == "" {
+			continue
+		}
+		for _, host := range tls.Hosts {
+			if _, ok := tlsSecrets[host]; !ok {
+				tlsSecrets[host] = fmt.Sprintf("%s/%s", ingress.Namespace, tls.SecretName)
+			}
+		}
+	}
+	rules := make([]IngressRule, 0, len(ingress.Spec.Rules))
+	indexes := make(map[string]int)
+	for _, rule := range ingress.Spec.Rules {
+		index, ok := indexes[rule.Host]
+		if !ok {
+			index = len(rules)
+			indexes[rule.Host] = index
+			rules = append(rules, IngressRule{Host: rule.Host, TLSSecret: tlsSecrets[rule.Host]})
+		}
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			vars := PathVars{Path: path.Path, Ingress: key}
+			if path.PathType != nil {
+				vars.PathType = string(*path.PathType)
+			}
+			if path.Backend.Service != nil {
+				vars.Service = fmt.Sprintf("%s/%s", ingress.Namespace, path.Backend.Service.Name)
+				vars.ServicePort = path.Backend.Service.Port.Name
+				if vars.ServicePort == "" {
+					vars.ServicePort = strconv.Itoa(int(path.Backend.Service.Port.Number))
+				}
+			}
+			rules[index].Paths = append(rules[index].Paths, vars)
+		}
+	}
+	return rules
+}
+
+// IngressWatcher discovers the hosts and paths of Ingresses
+type IngressWatcher struct {
+	kubernetesAPIs []kubernetes.Interface
+	ingresses      IngressesDescription
+	// synced, if not nil, is called once the initial list has been sent
+	synced func()
+	// listOnly, if set, stops the watcher once the initial list has been sent, instead of watching for changes
+	listOnly bool
+}
+
+func (i *IngressWatcher) processIngress(ingress *networkingv1.Ingress, events chan<- IngressEvent) {
+	key := ingressKey(ingress)
+	if !i.ingresses.handles(ingress) {
+		events <- IngressEvent{Ingress: key}
+		return
+	}
+	pool := i.ingresses.pool
+	if annotated, ok := ingress.Annotations[public.IngressPoolAnnotation]; ok && annotated != "" {
+		pool = annotated
+	}
+	rules := RulesFromIngress(ingress)
+	fmt.Printf("Ingress rules for pool %s: %s, %v\n", pool, key, rules)
+	events <- IngressEvent{Ingress: key, Pool: pool, Rules: rules}
+}
+
+func (i *IngressWatcher) Run(ctx context.Context, events chan<- IngressEvent, stop <-chan struct{}) error {
+	options := metav1.ListOptions{LabelSelector: i.ingresses.labelSelector}
+	watchEvents := make(chan watch.Event)
+	watchEnded := make(chan error, 1)
+	var initialList []networkingv1.Ingress
+	listed := false
+	for _, api := range i.kubernetesAPIs {
+		fmt.Printf("Getting initial list of ingresses: --namespace=%s --selector=%s\n", i.ingresses.namespace, i.ingresses.labelSelector)
+		if !listed {
+			ingresses, err := api.NetworkingV1().Ingresses(i.ingresses.namespace).List(ctx, options)
+			if err != nil {
+				fmt.Printf("Listing ingresses failed: %v\n", err)
+				continue // Maybe another call will succeed?
+			}
+			initialList = ingresses.Items
+			listed = true
+		}
+		if i.listOnly {
+			break
+		}
+		watcher, err := api.NetworkingV1().Ingresses(i.ingresses.namespace).Watch(ctx, options)
+		if err != nil {
+			return err
+		}
+		defer watcher.Stop()
+		go forwardWatch("ingresses", watcher, sendWatchEvent(watchEvents, stop), watchEnded)
+	}
+
+	if !listed {
+		return fmt.Errorf("Did not get an initial list of ingresses")
+	}
+
+	for _, ingress := range initialList {
+		i.processIngress(&ingress, events)
+	}
+	notifySynced(i.synced)
+	if i.listOnly {
+		return nil
+	}
+
+	running := true
+
+	for running {
+		select {
+		case watchEvent := <-watchEvents:
+			ingress, ok := watchEvent.Object.(*networkingv1.Ingress)
+			if !ok {
+				// TODO: Pass error
+				fmt.Printf("Unexpected watch event for ingresses: %#v\n", watchEvent)
+				continue
+			}
+			switch watchEvent.Type {
+			case watch.Added, watch.Modified:
+				i.processIngress(ingress, events)
+			case watch.Deleted:
+				events <- IngressEvent{Ingress: ingressKey(ingress)}
+			}
+		case err := <-watchEnded:
+			return err
+		case <-stop:
+			running = false
+		}
+	}
+	return nil
+}
+
+// hosts merges the rules of all ingresses into the template variables for each host, sorted by host.
+// If ingresses route the same host to different pools, the first ingress by namespace/name wins.
+func (d *Doorman) hosts(state *clusterState) []HostVars {
+	ingresses := make([]string, 0, len(state.ingresses))
+	for ingress := range state.ingresses {
+		ingresses = append(ingresses, ingress)
+	}
+	sort.Strings(ingresses)
+	hosts := make(map[string]*HostVars)
+	for _, ingress := range ingresses {
+		ingressState := state.ingresses[ingress]
+		poolState, ok := state.pools[ingressState.pool]
+		if !ok {
+			fmt.Printf("Ignoring ingress %s, there is no pool %s\n", ingress, ingressState.pool)
+			continue
+		}
+		for _, rule := range ingressState.rules {
+			host, ok := hosts[rule.Host]
+			if !ok {
+				addresses, fallbackAddresses := d.withFallback(state, ingressState.pool, nil)
+				addressList, backupAddressList := splitByZone(addresses, poolState.preferredZone)
+				backupAddressList = appendFallbacks(backupAddressList, addresses, fallbackAddresses)
+				host = &HostVars{Host: rule.Host, Pool: ingressState.pool, Addresses: addressList, BackupAddresses: backupAddressList}
+				hosts[rule.Host] = host
+			} else if host.Pool != ingressState.pool {
+				fmt.Printf("Ignoring host %q from ingress %s in pool %s, it conflicts with pool %s\n", rule.Host, ingress, ingressState.pool, host.Pool)
+				continue
+			}
+			if host.TLSSecret == "" {
+				host.TLSSecret = rule.TLSSecret
+			}
+			host.Paths = append(host.Paths, rule.Paths...)
+		}
+	}
+	list := make([]HostVars, 0, len(hosts))
+	for _, host := range hosts {
+		for _, secret := range state.tlsSecretVars() {
+			if host.TLSSecret != "" && secret.Secret == host.TLSSecret {
+				host.CertPath = secret.CertPath
+				host.KeyPath = secret.KeyPath
+				break
+			}
+		}
+		list = append(list, *host)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Host < list[j].Host
+	})
+	return list
+}
+
+// HostVars are the template variables for a single HTTP host
+type HostVars struct {
+	// Host is the hostname, which is empty for rules which match all hosts
+	Host string `json:"host"`
+	// Pool is the name of the pool the host is routed to
+	Pool      string   `json:"pool"`
+	Addresses []string `json:"addresses"`
+	// BackupAddresses are as for ports
+	BackupAddresses []string `json:"backupAddresses"`
+	// TLSSecret is the namespace/name of the secret with the certificate for the host, or empty if the host does not use TLS
+	TLSSecret string `json:"tlsSecret"`
+	// CertPath and KeyPath are where the TLS secret was written to, if it is one of the configured TLS secrets
+	CertPath string     `json:"certPath"`
+	KeyPath  string     `json:"keyPath"`
+	Paths    []PathVars `json:"paths"`
+}
+
+// PathVars are the template variables for a single path of a host
+type PathVars struct {
+	Path     string `json:"path"`
+	PathType string `json:"pathType"`
+	// Ingress is the namespace/name of the Ingress the path is from
+	Ingress string `json:"ingress"`
+	// Service is the namespace/name of the backend service, or empty if the backend is not a service
+	Service string `json:"service"`
+	// ServicePort is the name or number of the backend service's port
+	ServicePort string `json:"servicePort"`
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIngressesHandles(t *testing.T) {
+	className := func(name string) *string { return &name }
+	cases := []struct {
+		name      string
+		className string
+		ingress   networkingv1.Ingress
+		want      bool
+	}{
+		{name: "any class", ingress: networkingv1.Ingress{Spec: networkingv1.IngressSpec{IngressClassName: className("nginx")}}, want: true},
+		{name: "class name", className: "doorman", ingress: networkingv1.Ingress{Spec: networkingv1.IngressSpec{IngressClassName: className("doorman")}}, want: true},
+		{name: "other class name", className: "doorman", ingress: networkingv1.Ingress{Spec: networkingv1.IngressSpec{IngressClassName: className("nginx")}}},
+		{
+			name:      "class annotation",
+			className: "doorman",
+			ingress:   networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ingressClassAnnotation: "doorman"}}},
+			want:      true,
+		},
+		{
+			name:      "class name takes precedence over annotation",
+			className: "doorman",
+			ingress: networkingv1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ingressClassAnnotation: "doorman"}},
+				Spec:       networkingv1.IngressSpec{IngressClassName: className("nginx")},
+			},
+		},
+		{name: "no class", className: "doorman", ingress: networkingv1.Ingress{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			i := IngressesDescription{ingressClassName: c.className}
+			if got := i.handles(&c.ingress); got != c.want {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRulesFromIngress(t *testing.T) {
+	prefix := networkingv1.PathTypePrefix
+	backend := func(service, portName string, portNumber int32) networkingv1.IngressBackend {
+		return networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: service, Port: networkingv1.ServiceBackendPort{Name: portName, Number: portNumber}}}
+	}
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: networkingv1.IngressSpec{
+			TLS: []networkingv1.IngressTLS{
+				{Hosts: []string{"a.example.com"}, SecretName: "a-tls"},
+				{Hosts: []string{"a.example.com", "b.example.com"}, SecretName: "wildcard-tls"},
+				{Hosts: []string{"c.example.com"}},
+			},
+			Rules: []networkingv1.IngressRule{
+				{Host: "a.example.com", IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{Paths: []networkingv1.HTTPIngressPath{
+					{Path: "/", PathType: &prefix, Backend: backend("web", "http", 0)},
+				}}}},
+				{Host: "b.example.com"},
+				{Host: "a.example.com", IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{Paths: []networkingv1.HTTPIngressPath{
+					{Path: "/api", Backend: backend("api", "", 8080)},
+				}}}},
+				{Host: "c.example.com", IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{Paths: []networkingv1.HTTPIngressPath{
+					{Path: "/static"},
+				}}}},
+			},
+		},
+	}
+	want := []IngressRule{
+		{
+			Host:      "a.example.com",
+			TLSSecret: "default/a-tls",
+			Paths: []PathVars{
+				{Path: "/", PathType: "Prefix", Ingress: "default/web", Service: "default/web", ServicePort: "http"},
+				{Path: "/api", Ingress: "default/web", Service: "default/api", ServicePort: "8080"},
+			},
+		},
+		{Host: "b.example.com", TLSSecret: "default/wildcard-tls"},
+		{Host: "c.example.com", Paths: []PathVars{{Path: "/static", Ingress: "default/web"}}},
+	}
+	if got := RulesFromIngress(ingress); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	state := newClusterState()
+	state.pools["workers"] = newPoolState("")
+	state.pools["workers"].nodes["node-1"] = nodeState{addresses: []string{"10.0.0.1"}}
+	state.pools["infra"] = newPoolState("")
+	state.pools["infra"].nodes["node-2"] = nodeState{addresses: []string{"10.0.0.2"}}
+	state.ingresses["default/b"] = ingressState{pool: "workers", rules: []IngressRule{
+		{Host: "a.example.com", TLSSecret: "default/a-tls", Paths: []PathVars{{Path: "/b", Ingress: "default/b"}}},
+	}}
+	state.ingresses["default/a"] = ingressState{pool: "workers", rules: []IngressRule{
+		{Host: "a.example.com", Paths: []PathVars{{Path: "/a", Ingress: "default/a"}}},
+	}}
+	// The host is already routed to another pool by an ingress which sorts first
+	state.ingresses["default/c"] = ingressState{pool: "infra", rules: []IngressRule{
+		{Host: "a.example.com", Paths: []PathVars{{Path: "/c", Ingress: "default/c"}}},
+		{Host: "c.example.com", Paths: []PathVars{{Path: "/", Ingress: "default/c"}}},
+	}}
+	state.ingresses["default/d"] = ingressState{pool: "missing", rules: []IngressRule{{Host: "d.example.com"}}}
+	want := []HostVars{
+		{
+			Host:      "a.example.com",
+			Pool:      "workers",
+			Addresses: []string{"10.0.0.1"},
+			TLSSecret: "default/a-tls",
+			Paths:     []PathVars{{Path: "/a", Ingress: "default/a"}, {Path: "/b", Ingress: "default/b"}},
+		},
+		{Host: "c.example.com", Pool: "infra", Addresses: []string{"10.0.0.2"}, Paths: []PathVars{{Path: "/", Ingress: "default/c"}}},
+	}
+	var d Doorman
+	if got := d.hosts(state); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
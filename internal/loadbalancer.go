@@ -0,0 +1,465 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+type LoadBalancerDescription struct {
+	nodePool          string
+	addresses         []string
+	ports             []public.PortRange
+	loadBalancerClass string
+	namespace         string
+	labelSelector     string
+	options           PortOptions
+}
+
+func (l *LoadBalancerDescription) FromConfig(cfg *public.LoadBalancerConfigFile) error {
+	if cfg.NodePool == "" {
+		return fmt.Errorf("A node pool is required")
+	}
+	if len(cfg.Addresses) == 0 {
+		return fmt.Errorf("At least one address is required")
+	}
+	l.nodePool = cfg.NodePool
+	l.addresses = cfg.Addresses
+	for _, ports := range cfg.Ports {
+		if err := ports.Validate(); err != nil {
+			return err
+		}
+	}
+	l.ports = cfg.Ports
+	l.loadBalancerClass = cfg.LoadBalancerClass
+	l.namespace = cfg.Namespace
+	if cfg.Labels != nil {
+		selector, err := metav1.LabelSelectorAsSelector(cfg.Labels)
+		if err != nil {
+			return err
+		}
+		l.labelSelector = selector.String()
+	}
+	l.options.FromConfig(cfg.PortOptions)
+	return nil
+}
+
+// handles returns true if a service should be assigned an address
+func (l *LoadBalancerDescription) handles(svc *corev1.Service) bool {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return false
+	}
+	if svc.Spec.LoadBalancerClass == nil {
+		return l.loadBalancerClass == ""
+	}
+	return *svc.Spec.LoadBalancerClass == l.loadBalancerClass
+}
+
+// hasAddress returns true if an address is one that may be assigned
+func (l *LoadBalancerDescription) hasAddress(address string) bool {
+	for _, candidate := range l.addresses {
+		if candidate == address {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPort returns true if a port may be listened on
+func (l *LoadBalancerDescription) allowsPort(port int) bool {
+	if len(l.ports) == 0 {
+		return true
+	}
+	for _, ports := range l.ports {
+		if ports.First <= port && port <= ports.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// PortsFromService returns a mapping from each port of a service on an address to the corresponding NodePort
+func (l *LoadBalancerDescription) PortsFromService(svc *corev1.Service, address string) []PortMapping {
+	localService := ""
+	if svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+		localService = serviceKey(svc)
+	}
+	ports := make([]PortMapping, 0, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		if port.NodePort == 0 {
+			continue
+		}
+		if port.Protocol != corev1.ProtocolTCP && port.Protocol != corev1.ProtocolUDP {
+			continue
+		}
+		ports = append(ports, PortMapping{
+			Source:       int(port.Port),
+			Dest:         int(port.NodePort),
+			Address:      address,
+			Protocol:     port.Protocol,
+			Range:        public.PortRange{First: int(port.Port), Last: int(port.Port)},
+			LocalService: localService,
+			PortOptions:  l.options,
+		})
+	}
+	return ports
+}
+
+// loadBalancerIngress returns the status entry for an address
+func loadBalancerIngress(address string) corev1.LoadBalancerIngress {
+	if net.ParseIP(address) != nil {
+		return corev1.LoadBalancerIngress{IP: address}
+	}
+	return corev1.LoadBalancerIngress{Hostname: address}
+}
+
+// listenerClaims are the listeners of ports discovered from Services for node pools, which are shared between the watchers of a session
+// so that the load balancer controller does not assign them
+type listenerClaims struct {
+	mu sync.Mutex
+	// listeners maps each service and pool to its (normalized) listeners
+	listeners map[string][]Listener
+	// changed receives a value when any claim changes
+	changed chan struct{}
+}
+
+func newListenerClaims() *listenerClaims {
+	return &listenerClaims{listeners: make(map[string][]Listener), changed: make(chan struct{}, 1)}
+}
+
+// set replaces the listeners claimed by a service for a pool
+func (c *listenerClaims) set(pool, service string, ports []PortMapping) {
+	listeners := make([]Listener, 0, len(ports))
+	for _, port := range ports {
+		listeners = append(listeners, port.Listener().normalized())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := fmt.Sprintf("%s in pool %s", service, pool)
+	if reflect.DeepEqual(c.listeners[key], listeners) || (len(c.listeners[key]) == 0 && len(listeners) == 0) {
+		return
+	}
+	if len(listeners) == 0 {
+		delete(c.listeners, key)
+	} else {
+		c.listeners[key] = listeners
+	}
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// owner returns the service and pool which claimed a (normalized) listener, if any
+func (c *listenerClaims) owner(listener Listener) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for owner, listeners := range c.listeners {
+		for _, claimed := range listeners {
+			if claimed == listener {
+				return owner, true
+			}
+		}
+	}
+	return "", false
+}
+
+// LoadBalancerController assigns an address to each Service of type LoadBalancer, sends the resulting ports for its node pool, and writes the address to the Service's status
+type LoadBalancerController struct {
+	kubernetesAPIs []kubernetes.Interface
+	loadBalancer   LoadBalancerDescription
+	// reserved are the (normalized) listeners which are already used by node pools, and cannot be assigned
+	reserved map[Listener]struct{}
+	// claims, if not nil, are the listeners of ports discovered from Services, which cannot be assigned either
+	claims *listenerClaims
+
+	// assigned maps the namespace/name of each service to its address
+	assigned map[string]string
+	// used maps each (normalized) listener assigned to a service to the namespace/name of that service
+	used map[Listener]string
+	// pending are services which could not be assigned an address, by namespace/name
+	pending map[string]*corev1.Service
+	// services are the last seen version of each service which was assigned an address, by namespace/name
+	services map[string]*corev1.Service
+	// synced, if not nil, is called once the initial list has been sent
+	synced func()
+}
+
+func serviceKey(svc *corev1.Service) string {
+	return fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)
+}
+
+// loadBalancerPortsPrefix starts the key used for a service's ports within its node pool, distinct from the key used for the same service's NodePorts
+const loadBalancerPortsPrefix = "LoadBalancer "
+
+// portsKey is the key used for a service's ports within its node pool
+func (l *LoadBalancerController) portsKey(key string) string {
+	return loadBalancerPortsPrefix + key
+}
+
+// isLoadBalancerPorts returns true if the key of a service's ports within a pool is for ports assigned by the load balancer controller
+func isLoadBalancerPorts(key string) bool {
+	return strings.HasPrefix(key, loadBalancerPortsPrefix)
+}
+
+// candidates returns the addresses to try to assign to a service, in order of preference.
+// If the service requests an address, only that address is a candidate.
+// Otherwise, the address the service was assigned before it was released is preferred, if any, then an address already in the service's status,
+// so that addresses are kept across updates and restarts.
+func (l *LoadBalancerController) candidates(svc *corev1.Service, previous string) []string {
+	if svc.Spec.LoadBalancerIP != "" {
+		if !l.loadBalancer.hasAddress(svc.Spec.LoadBalancerIP) {
+			return nil
+		}
+		return []string{svc.Spec.LoadBalancerIP}
+	}
+	candidates := make([]string, 0, len(l.loadBalancer.addresses)+1)
+	if previous != "" {
+		candidates = append(candidates, previous)
+	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		for _, address := range []string{ingress.IP, ingress.Hostname} {
+			if address != "" && l.loadBalancer.hasAddress(address) {
+				candidates = append(candidates, address)
+			}
+		}
+	}
+	return append(candidates, l.loadBalancer.addresses...)
+}
+
+// assign finds an address on which all of a service's ports are free, preferring the address it was previously assigned, and marks those ports as used
+func (l *LoadBalancerController) assign(svc *corev1.Service, previous string) (string, []PortMapping, error) {
+	key := serviceKey(svc)
+	var lastErr error
+	for _, address := range l.candidates(svc, previous) {
+		ports := l.loadBalancer.PortsFromService(svc, address)
+		if len(ports) == 0 {
+			return "", nil, fmt.Errorf("Service has no NodePorts")
+		}
+		lastErr = nil
+		for _, port := range ports {
+			listener := port.Listener()
+			if !l.loadBalancer.allowsPort(port.Source) {
+				return "", nil, fmt.Errorf("Port %d is not allowed", port.Source)
+			}
+			if _, ok := l.reserved[listener.normalized()]; ok {
+				lastErr = fmt.Errorf("Listener %s is used by a node pool", listener)
+				break
+			}
+			if owner, ok := l.claims.owner(listener.normalized()); ok {
+				lastErr = fmt.Errorf("Listener %s is used by service %s", listener, owner)
+				break
+			}
+			if owner, ok := l.used[listener.normalized()]; ok && owner != key {
+				lastErr = fmt.Errorf("Listener %s is used by service %s", listener, owner)
+				break
+			}
+		}
+		if lastErr != nil {
+			continue
+		}
+		for _, port := range ports {
+			l.used[port.Listener().normalized()] = key
+		}
+		l.assigned[key] = address
+		return address, ports, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("Requested address %s is not one of %v", svc.Spec.LoadBalancerIP, l.loadBalancer.addresses)
+	}
+	return "", nil, lastErr
+}
+
+// release frees the address and listeners assigned to a service, and returns them
+func (l *LoadBalancerController) release(key string) (string, []Listener) {
+	address := l.assigned[key]
+	delete(l.assigned, key)
+	delete(l.services, key)
+	var released []Listener
+	for listener, owner := range l.used {
+		if owner == key {
+			delete(l.used, listener)
+			released = append(released, listener)
+		}
+	}
+	return address, released
+}
+
+// freed returns true if a service no longer uses any of the listeners it released
+func (l *LoadBalancerController) freed(key string, released []Listener) bool {
+	for _, listener := range released {
+		if l.used[listener] != key {
+			return true
+		}
+	}
+	return false
+}
+
+// updateStatus sets the ingress status of a service, if it has changed, using the first API that succeeds
+func (l *LoadBalancerController) updateStatus(ctx context.Context, svc *corev1.Service, ingress []corev1.LoadBalancerIngress) {
+	if reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, ingress) || (len(svc.Status.LoadBalancer.Ingress) == 0 && len(ingress) == 0) {
+		return
+	}
+	updated := svc.DeepCopy()
+	updated.Status.LoadBalancer.Ingress = ingress
+	for _, api := range l.kubernetesAPIs {
+		_, err := api.CoreV1().Services(svc.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+		if err == nil {
+			return
+		}
+		fmt.Printf("Updating status of service %s failed: %v\n", serviceKey(svc), err)
+	}
+}
+
+// ownsStatus returns true if the status of a service contains an address which this controller could have assigned
+func (l *LoadBalancerController) ownsStatus(svc *corev1.Service) bool {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if l.loadBalancer.hasAddress(ingress.IP) || l.loadBalancer.hasAddress(ingress.Hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// sync re-assigns a service which was added or modified, and updates its ports and status.
+// It returns true if the service freed any listeners, which pending services may now fit on.
+func (l *LoadBalancerController) sync(ctx context.Context, svc *corev1.Service, events chan<- ServicePortsEvent) bool {
+	key := serviceKey(svc)
+	previous, released := l.release(key)
+	delete(l.pending, key)
+	if !l.loadBalancer.handles(svc) {
+		events <- ServicePortsEvent{Pool: l.loadBalancer.nodePool, Service: l.portsKey(key)}
+		if l.ownsStatus(svc) {
+			l.updateStatus(ctx, svc, nil)
+		}
+		return l.freed(key, released)
+	}
+	address, ports, err := l.assign(svc, previous)
+	if err != nil {
+		fmt.Printf("Could not assign an address to service %s: %v\n", key, err)
+		l.pending[key] = svc
+		events <- ServicePortsEvent{Pool: l.loadBalancer.nodePool, Service: l.portsKey(key)}
+		if l.ownsStatus(svc) {
+			// Keep the service pending, instead of advertising an address it can no longer be reached on
+			l.updateStatus(ctx, svc, nil)
+		}
+		return l.freed(key, released)
+	}
+	fmt.Printf("Assigned address %s to service %s\n", address, key)
+	l.services[key] = svc
+	events <- ServicePortsEvent{Pool: l.loadBalancer.nodePool, Service: l.portsKey(key), Ports: ports}
+	l.updateStatus(ctx, svc, []corev1.LoadBalancerIngress{loadBalancerIngress(address)})
+	return l.freed(key, released)
+}
+
+// remove releases a deleted service, and retries any pending services which may now fit
+func (l *LoadBalancerController) remove(ctx context.Context, svc *corev1.Service, events chan<- ServicePortsEvent) {
+	key := serviceKey(svc)
+	_, released := l.release(key)
+	delete(l.pending, key)
+	events <- ServicePortsEvent{Pool: l.loadBalancer.nodePool, Service: l.portsKey(key)}
+	if len(released) != 0 {
+		l.retryPending(ctx, events)
+	}
+}
+
+// recheckClaims re-assigns any service which uses a listener that was since claimed by discovered service ports, and retries pending services which may now fit
+func (l *LoadBalancerController) recheckClaims(ctx context.Context, events chan<- ServicePortsEvent) {
+	conflicts := make(map[string]struct{})
+	for listener, key := range l.used {
+		if _, ok := l.claims.owner(listener); ok {
+			conflicts[key] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(conflicts))
+	for key := range conflicts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("Service %s uses a listener which is now used by service ports, re-assigning it\n", key)
+		l.sync(ctx, l.services[key], events)
+	}
+	l.retryPending(ctx, events)
+}
+
+func (l *LoadBalancerController) retryPending(ctx context.Context, events chan<- ServicePortsEvent) {
+	keys := make([]string, 0, len(l.pending))
+	for key := range l.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l.sync(ctx, l.pending[key], events)
+	}
+}
+
+func (l *LoadBalancerController) Run(ctx context.Context, events chan<- ServicePortsEvent, stop <-chan struct{}) error {
+	l.assigned = make(map[string]string)
+	l.used = make(map[Listener]string)
+	l.pending = make(map[string]*corev1.Service)
+	l.services = make(map[string]*corev1.Service)
+	var claimsChanged <-chan struct{}
+	if l.claims != nil {
+		claimsChanged = l.claims.changed
+	}
+	watchEvents := make(chan watch.Event)
+	watchEnded := make(chan error, 1)
+	initialList, stopWatches, err := watchServices(ctx, l.kubernetesAPIs, l.loadBalancer.namespace, l.loadBalancer.labelSelector, false, watchEvents, watchEnded, stop)
+	if err != nil {
+		return err
+	}
+	defer stopWatches()
+
+	// Services which already have one of the addresses go first, so that they keep them
+	sort.SliceStable(initialList, func(i, j int) bool {
+		return l.ownsStatus(&initialList[i]) && !l.ownsStatus(&initialList[j])
+	})
+	for i := range initialList {
+		l.sync(ctx, &initialList[i], events)
+	}
+	notifySynced(l.synced)
+
+	running := true
+
+	for running {
+		select {
+		case watchEvent := <-watchEvents:
+			svc, ok := watchEvent.Object.(*corev1.Service)
+			if !ok {
+				// TODO: Pass error
+				fmt.Printf("Unexpected watch event for load balancer: %#v\n", watchEvent)
+				continue
+			}
+			switch watchEvent.Type {
+			case watch.Added, watch.Modified:
+				if l.sync(ctx, svc, events) {
+					// A modified service may have released ports another is waiting for
+					l.retryPending(ctx, events)
+				}
+			case watch.Deleted:
+				l.remove(ctx, svc, events)
+			}
+		case <-claimsChanged:
+			l.recheckClaims(ctx, events)
+		case err := <-watchEnded:
+			return err
+		case <-stop:
+			running = false
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func loadBalancerService(name string, port, nodePort int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: port, NodePort: nodePort}},
+		},
+	}
+}
+
+// loadBalancerHarness runs a LoadBalancerController against a fake API server
+type loadBalancerHarness struct {
+	t      *testing.T
+	ctx    context.Context
+	client *fake.Clientset
+	events chan ServicePortsEvent
+}
+
+func startLoadBalancer(t *testing.T, addresses []string, reserved map[Listener]struct{}, claims *listenerClaims, existing ...*corev1.Service) *loadBalancerHarness {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, svc := range existing {
+		if _, err := client.CoreV1().Services(svc.Namespace).Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	synced := make(chan struct{})
+	controller := LoadBalancerController{
+		kubernetesAPIs: []kubernetes.Interface{client},
+		loadBalancer:   LoadBalancerDescription{nodePool: "workers", addresses: addresses},
+		reserved:       reserved,
+		claims:         claims,
+		synced:         func() { close(synced) },
+	}
+	h := &loadBalancerHarness{t: t, ctx: ctx, client: client, events: make(chan ServicePortsEvent, 100)}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- controller.Run(ctx, h.events, stop) }()
+	t.Cleanup(func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		cancel()
+	})
+	select {
+	case <-synced:
+	case err := <-done:
+		t.Fatalf("Controller failed before syncing: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the controller to sync")
+	}
+	return h
+}
+
+// expectPorts waits for the ports of a service, skipping any other events, and fails if it is not assigned them
+func (h *loadBalancerHarness) expectPorts(name string, want []PortMapping) {
+	h.t.Helper()
+	key := loadBalancerPortsPrefix + "default/" + name
+	timeout := time.After(5 * time.Second)
+	var last *ServicePortsEvent
+	for {
+		select {
+		case event := <-h.events:
+			if event.Pool != "workers" {
+				h.t.Fatalf("Got an event for pool %s", event.Pool)
+			}
+			if event.Service != key {
+				continue
+			}
+			last = &event
+			if len(event.Ports) == len(want) && (len(want) == 0 || reflect.DeepEqual(event.Ports, want)) {
+				return
+			}
+		case <-timeout:
+			h.t.Fatalf("Timed out waiting for ports %v of service %s, last got %+v", want, name, last)
+		}
+	}
+}
+
+// expectStatus waits for the status of a service to have an address, or none if address is empty
+func (h *loadBalancerHarness) expectStatus(name, address string) {
+	h.t.Helper()
+	var want []corev1.LoadBalancerIngress
+	if address != "" {
+		want = []corev1.LoadBalancerIngress{{IP: address}}
+	}
+	var got []corev1.LoadBalancerIngress
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		svc, err := h.client.CoreV1().Services("default").Get(h.ctx, name, metav1.GetOptions{})
+		if err != nil {
+			h.t.Fatal(err)
+		}
+		got = svc.Status.LoadBalancer.Ingress
+		if reflect.DeepEqual(got, want) || (len(got) == 0 && len(want) == 0) {
+			return
+		}
+	}
+	h.t.Fatalf("Got status %v for service %s, want %v", got, name, want)
+}
+
+func (h *loadBalancerHarness) create(svc *corev1.Service) {
+	h.t.Helper()
+	if _, err := h.client.CoreV1().Services(svc.Namespace).Create(h.ctx, svc, metav1.CreateOptions{}); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func (h *loadBalancerHarness) delete(name string) {
+	h.t.Helper()
+	if err := h.client.CoreV1().Services("default").Delete(h.ctx, name, metav1.DeleteOptions{}); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func loadBalancerPorts(address string, port, nodePort int) []PortMapping {
+	return []PortMapping{{Source: port, Dest: nodePort, Address: address, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: port, Last: port}}}
+}
+
+func TestLoadBalancerControllerAssigns(t *testing.T) {
+	h := startLoadBalancer(t, []string{"10.0.0.10", "10.0.0.11"}, nil, nil, loadBalancerService("web", 80, 30080))
+	h.expectPorts("web", loadBalancerPorts("10.0.0.10", 80, 30080))
+	h.expectStatus("web", "10.0.0.10")
+
+	// The same port is free on the next address
+	h.create(loadBalancerService("api", 80, 30081))
+	h.expectPorts("api", loadBalancerPorts("10.0.0.11", 80, 30081))
+	h.expectStatus("api", "10.0.0.11")
+
+	// A service of another type is not assigned an address
+	other := loadBalancerService("internal", 80, 30082)
+	other.Spec.Type = corev1.ServiceTypeNodePort
+	h.create(other)
+	h.expectPorts("internal", nil)
+	h.expectStatus("internal", "")
+}
+
+func TestLoadBalancerControllerKeepsAddress(t *testing.T) {
+	svc := loadBalancerService("web", 80, 30080)
+	svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.11"}}
+	h := startLoadBalancer(t, []string{"10.0.0.10", "10.0.0.11"}, nil, nil, svc)
+	h.expectPorts("web", loadBalancerPorts("10.0.0.11", 80, 30080))
+	h.expectStatus("web", "10.0.0.11")
+}
+
+func TestLoadBalancerControllerRetriesPending(t *testing.T) {
+	h := startLoadBalancer(t, []string{"10.0.0.10"}, nil, nil, loadBalancerService("web", 80, 30080))
+	h.expectPorts("web", loadBalancerPorts("10.0.0.10", 80, 30080))
+	h.expectStatus("web", "10.0.0.10")
+
+	// The only address already has the port, so the service is pending
+	h.create(loadBalancerService("api", 80, 30081))
+	h.expectPorts("api", nil)
+	h.expectStatus("api", "")
+
+	// Deleting the first service releases its port, so the pending one is assigned it
+	h.delete("web")
+	h.expectPorts("web", nil)
+	h.expectPorts("api", loadBalancerPorts("10.0.0.10", 80, 30081))
+	h.expectStatus("api", "10.0.0.10")
+}
+
+func TestLoadBalancerControllerRetriesOnModify(t *testing.T) {
+	h := startLoadBalancer(t, []string{"10.0.0.10"}, nil, nil, loadBalancerService("web", 80, 30080))
+	h.expectPorts("web", loadBalancerPorts("10.0.0.10", 80, 30080))
+	h.create(loadBalancerService("api", 80, 30081))
+	h.expectPorts("api", nil)
+
+	// Moving the first service to another port frees its old one for the pending service
+	web, err := h.client.CoreV1().Services("default").Get(h.ctx, "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web.Spec.Ports[0].Port = 8080
+	if _, err := h.client.CoreV1().Services("default").Update(h.ctx, web, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	h.expectPorts("web", loadBalancerPorts("10.0.0.10", 8080, 30080))
+	h.expectPorts("api", loadBalancerPorts("10.0.0.10", 80, 30081))
+	h.expectStatus("api", "10.0.0.10")
+}
+
+func TestLoadBalancerControllerCandidates(t *testing.T) {
+	l := LoadBalancerController{loadBalancer: LoadBalancerDescription{addresses: []string{"10.0.0.10", "10.0.0.11", "10.0.0.12"}}}
+	cases := []struct {
+		name     string
+		svc      *corev1.Service
+		previous string
+		want     []string
+	}{
+		{name: "any address", svc: loadBalancerService("web", 80, 30080), want: []string{"10.0.0.10", "10.0.0.11", "10.0.0.12"}},
+		{name: "previous address", svc: loadBalancerService("web", 80, 30080), previous: "10.0.0.12", want: []string{"10.0.0.12", "10.0.0.10", "10.0.0.11", "10.0.0.12"}},
+		{
+			name: "address in status",
+			svc: func() *corev1.Service {
+				svc := loadBalancerService("web", 80, 30080)
+				svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.0.1"}, {IP: "10.0.0.11"}}
+				return svc
+			}(),
+			previous: "10.0.0.12",
+			want:     []string{"10.0.0.12", "10.0.0.11", "10.0.0.10", "10.0.0.11", "10.0.0.12"},
+		},
+		{
+			name: "requested address",
+			svc: func() *corev1.Service {
+				svc := loadBalancerService("web", 80, 30080)
+				svc.Spec.LoadBalancerIP = "10.0.0.11"
+				return svc
+			}(),
+			previous: "10.0.0.12",
+			want:     []string{"10.0.0.11"},
+		},
+		{
+			name: "requested address which is not available",
+			svc: func() *corev1.Service {
+				svc := loadBalancerService("web", 80, 30080)
+				svc.Spec.LoadBalancerIP = "192.168.0.1"
+				return svc
+			}(),
+			want: nil,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := l.candidates(c.svc, c.previous); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerControllerReleasesOnDelete(t *testing.T) {
+	h := startLoadBalancer(t, []string{"10.0.0.10"}, nil, nil, loadBalancerService("web", 80, 30080))
+	h.expectPorts("web", loadBalancerPorts("10.0.0.10", 80, 30080))
+	h.delete("web")
+	h.expectPorts("web", nil)
+
+	// A new service can use the released port
+	h.create(loadBalancerService("api", 80, 30081))
+	h.expectPorts("api", loadBalancerPorts("10.0.0.10", 80, 30081))
+	h.expectStatus("api", "10.0.0.10")
+}
+
+func TestLoadBalancerControllerConflicts(t *testing.T) {
+	reserved := map[Listener]struct{}{{Address: "10.0.0.10", Protocol: corev1.ProtocolTCP, Port: 443}: {}}
+	claims := newListenerClaims()
+	h := startLoadBalancer(t, []string{"10.0.0.10"}, reserved, claims, loadBalancerService("web", 80, 30080))
+	h.expectPorts("web", loadBalancerPorts("10.0.0.10", 80, 30080))
+
+	// A port of a node pool is not assigned
+	h.create(loadBalancerService("secure", 443, 30443))
+	h.expectPorts("secure", nil)
+	h.expectStatus("secure", "")
+
+	// A port discovered from a service takes over the port, so the service is unassigned, and its status cleared
+	claims.set("workers", "default/ingress", []PortMapping{{Source: 80, Dest: 30090, Address: "10.0.0.10", Protocol: corev1.ProtocolTCP}})
+	h.expectPorts("web", nil)
+	h.expectStatus("web", "")
+
+	// The service is assigned again once the port is no longer claimed
+	claims.set("workers", "default/ingress", nil)
+	h.expectPorts("web", loadBalancerPorts("10.0.0.10", 80, 30080))
+	h.expectStatus("web", "10.0.0.10")
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Version is the version of doorman, which is set when building, e.g. with -ldflags "-X github.com/meln5674/doorman/internal.Version=v1.2.3"
+var Version = "dev"
+
+// KubernetesVars describe a Kubernetes context which doorman watches
+type KubernetesVars struct {
+	Context string `json:"context"`
+	Cluster string `json:"cluster"`
+	Server  string `json:"server"`
+}
+
+// MetaVars describe the render of a template, e.g. for a header which can be correlated with the logs of doorman.
+// Everything but Generation and RenderedAt is the same for every render, so that a render of unchanged state does not change any file.
+type MetaVars struct {
+	// Version is the version of doorman
+	Version string `json:"version"`
+	// ConfigPath is the absolute path of the config file
+	ConfigPath string `json:"configPath"`
+	// ConfigHash is the sha256 hash of the config file
+	ConfigHash string `json:"configHash"`
+	// Kubernetes are the contexts being watched, sorted by name
+	Kubernetes []KubernetesVars `json:"kubernetes"`
+	// Generation increases by one each time the state changes, and is kept in the state file, if there is one, across restarts
+	Generation int64 `json:"generation"`
+	// RenderedAt is when the generation was first rendered
+	RenderedAt time.Time `json:"renderedAt"`
+}
+
+// SetConfigFile records the config file doorman was configured from, for the metadata given to templates
+func (d *Doorman) SetConfigFile(path string, data []byte) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	d.meta.ConfigPath = path
+	d.meta.ConfigHash = contentHash(data)
+}
+
+// addKubernetes records a context being watched, for the metadata given to templates
+func (d *Doorman) addKubernetes(context, cluster, server string) {
+	d.meta.Kubernetes = append(d.meta.Kubernetes, KubernetesVars{Context: context, Cluster: cluster, Server: server})
+	sort.Slice(d.meta.Kubernetes, func(i, j int) bool { return d.meta.Kubernetes[i].Context < d.meta.Kubernetes[j].Context })
+}
+
+// generate starts a new generation if the state changed since the last one, and returns the metadata to render it with
+func (d *Doorman) generate(templateVars TemplateVars, now time.Time) MetaVars {
+	if d.generated == nil || !reflect.DeepEqual(*d.generated, templateVars) {
+		d.meta.Generation++
+		d.meta.RenderedAt = now.UTC().Truncate(time.Second)
+		d.generated = &templateVars
+	}
+	meta := d.meta
+	meta.Version = Version
+	return meta
+}
+
+// restoreGeneration continues the generations of a previous run from its saved state
+func (d *Doorman) restoreGeneration(saved *savedState) {
+	d.meta.Generation = saved.Generation
+	d.meta.RenderedAt = saved.RenderedAt
+	d.generated = &saved.Vars
+}
+
+func (m MetaVars) String() string {
+	return fmt.Sprintf("doorman %s, generation %d, rendered at %s from %s (sha256 %s)", m.Version, m.Generation, m.RenderedAt.Format(time.RFC3339), m.ConfigPath, m.ConfigHash)
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	var d Doorman
+	start := time.Date(2021, 9, 1, 12, 0, 0, 500, time.UTC)
+	vars := TemplateVars{TCPPorts: []PortVars{{Name: "tcp_80", Addresses: []string{"10.0.0.1"}}}}
+
+	meta := d.generate(vars, start)
+	if meta.Generation != 1 || !meta.RenderedAt.Equal(start.Truncate(time.Second)) || meta.Version != Version {
+		t.Errorf("Got %+v for the first render", meta)
+	}
+	// Rendering the same state again, e.g. for a resync, keeps the generation and its time
+	if meta := d.generate(vars, start.Add(time.Minute)); meta.Generation != 1 || !meta.RenderedAt.Equal(start.Truncate(time.Second)) {
+		t.Errorf("Got %+v for an unchanged render", meta)
+	}
+	changed := TemplateVars{TCPPorts: []PortVars{{Name: "tcp_80", Addresses: []string{"10.0.0.2"}}}}
+	if meta := d.generate(changed, start.Add(time.Hour)); meta.Generation != 2 || !meta.RenderedAt.Equal(start.Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("Got %+v for a changed render", meta)
+	}
+}
+
+func TestRestoreGeneration(t *testing.T) {
+	vars := TemplateVars{TCPPorts: []PortVars{{Name: "tcp_80", Addresses: []string{"10.0.0.1"}}}}
+	renderedAt := time.Date(2021, 9, 1, 12, 0, 0, 0, time.UTC)
+	var d Doorman
+	d.restoreGeneration(&savedState{Vars: vars, Generation: 7, RenderedAt: renderedAt})
+
+	// The saved state continues its generation, and a change starts the next one
+	if meta := d.generate(vars, time.Now()); meta.Generation != 7 || !meta.RenderedAt.Equal(renderedAt) {
+		t.Errorf("Got %+v for the saved state", meta)
+	}
+	if meta := d.generate(TemplateVars{}, time.Now()); meta.Generation != 8 {
+		t.Errorf("Got generation %d after a change, want 8", meta.Generation)
+	}
+}
+
+func TestMetaVars(t *testing.T) {
+	var d Doorman
+	d.SetConfigFile("doorman.yaml", []byte("templates: []\n"))
+	if !filepath.IsAbs(d.meta.ConfigPath) || d.meta.ConfigHash != contentHash([]byte("templates: []\n")) {
+		t.Errorf("Got config %s with hash %s", d.meta.ConfigPath, d.meta.ConfigHash)
+	}
+	d.addKubernetes("prod", "prod-cluster", "https://10.0.0.1:6443")
+	d.addKubernetes("dev", "dev-cluster", "https://10.1.0.1:6443")
+	want := []KubernetesVars{
+		{Context: "dev", Cluster: "dev-cluster", Server: "https://10.1.0.1:6443"},
+		{Context: "prod", Cluster: "prod-cluster", Server: "https://10.0.0.1:6443"},
+	}
+	if !reflect.DeepEqual(d.meta.Kubernetes, want) {
+		t.Errorf("Got contexts %+v, want %+v", d.meta.Kubernetes, want)
+	}
+}
@@ -6,42 +6,169 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
-	corev1api "k8s.io/client-go/kubernetes/typed/core/v1"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
 
 	public "github.com/meln5674/doorman/pkg/doorman"
 )
 
 type PortMapping struct {
-	Source int
-	Dest   int
+	Source   int
+	Dest     int
+	Address  string
+	Protocol corev1.Protocol
+	// Range is the range of source ports this mapping was expanded from, which contains only the source port if a range was not configured
+	Range public.PortRange
+	// LocalService is the namespace/name of the service whose endpoints' nodes traffic is limited to, if not empty
+	LocalService string
+	PortOptions
 }
 
-func (p *PortMapping) FromConfig(cfg public.PortMapping) {
-	p.Source = cfg.Source
-	if cfg.Dest == nil {
-		p.Dest = cfg.Source
-	} else {
-		p.Dest = *cfg.Dest
+// PortMappingsFromConfig expands a port mapping from the config file into one mapping per source port
+func PortMappingsFromConfig(cfg public.PortMapping, protocol corev1.Protocol) ([]PortMapping, error) {
+	if err := cfg.Source.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Dest != nil && cfg.Source.IsRange() {
+		return nil, fmt.Errorf("Port range %s cannot have a dest, use offset instead", cfg.Source)
+	}
+	if cfg.Dest != nil && cfg.Offset != 0 {
+		return nil, fmt.Errorf("Port %s cannot have both a dest and an offset", cfg.Source)
+	}
+	var options PortOptions
+	options.FromConfig(cfg.PortOptions)
+	localService := ""
+	if cfg.LocalService != nil {
+		if cfg.LocalService.Name == "" {
+			return nil, fmt.Errorf("Port %s has a local service with no name", cfg.Source)
+		}
+		localService = cfg.LocalService.Key()
+	}
+	mappings := make([]PortMapping, 0, cfg.Source.Last-cfg.Source.First+1)
+	for port := cfg.Source.First; port <= cfg.Source.Last; port++ {
+		dest := port + cfg.Offset
+		if cfg.Dest != nil {
+			dest = *cfg.Dest
+		}
+		if dest < 1 || dest > 65535 {
+			return nil, fmt.Errorf("Port %d is mapped to %d, which is outside of 1-65535", port, dest)
+		}
+		mappings = append(mappings, PortMapping{
+			Source:       port,
+			Dest:         dest,
+			Address:      cfg.ListenAddress,
+			Protocol:     protocol,
+			Range:        cfg.Source,
+			LocalService: localService,
+			PortOptions:  options,
+		})
 	}
+	return mappings, nil
+}
+
+// PortOptions are the load balancing settings for a port, passed through to templates as-is. Unset timeouts are zero.
+type PortOptions struct {
+	Algorithm      string            `json:"algorithm,omitempty"`
+	ConnectTimeout time.Duration     `json:"connectTimeout,omitempty"`
+	IdleTimeout    time.Duration     `json:"idleTimeout,omitempty"`
+	MaxFails       *int              `json:"maxFails,omitempty"`
+	ProxyProtocol  bool              `json:"proxyProtocol,omitempty"`
+	Options        map[string]string `json:"options,omitempty"`
+}
+
+// Listener returns the address, protocol, and port the load balancer listens on for this mapping
+func (p *PortMapping) Listener() Listener {
+	return Listener{Address: p.Address, Protocol: p.Protocol, Port: p.Source}
+}
+
+// Listener identifies a single socket the load balancer listens on. An empty address means all addresses.
+type Listener struct {
+	Address  string
+	Protocol corev1.Protocol
+	Port     int
+}
+
+func (l Listener) String() string {
+	address := l.Address
+	if address == "" {
+		address = "*"
+	}
+	return fmt.Sprintf("%s/%s", strings.ToLower(string(l.Protocol)), net.JoinHostPort(address, strconv.Itoa(l.Port)))
+}
+
+// Name returns an identifier for the listener which contains only letters, digits, and underscores
+func (l Listener) Name() string {
+	name := strings.ToLower(string(l.Protocol))
+	if l.Address != "" {
+		name += "_" + strings.Map(func(r rune) rune {
+			if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+				return r
+			}
+			return '_'
+		}, l.Address)
+	}
+	return fmt.Sprintf("%s_%d", name, l.Port)
+}
+
+// normalized returns the listener with its address in canonical form, so that equivalent listeners compare equal.
+// The IPv4 wildcard is the same as the empty address, but the IPv6 wildcard is not, as they are separate sockets.
+func (l Listener) normalized() Listener {
+	ip := net.ParseIP(l.Address)
+	switch {
+	case ip == nil:
+	case ip.To4() != nil && ip.IsUnspecified():
+		l.Address = ""
+	default:
+		l.Address = ip.String()
+	}
+	return l
+}
+
+func (p *PortOptions) FromConfig(cfg public.PortOptions) {
+	p.Algorithm = cfg.Algorithm
+	if cfg.ConnectTimeout != nil {
+		p.ConnectTimeout = cfg.ConnectTimeout.Duration
+	}
+	if cfg.IdleTimeout != nil {
+		p.IdleTimeout = cfg.IdleTimeout.Duration
+	}
+	p.MaxFails = cfg.MaxFails
+	p.ProxyProtocol = cfg.ProxyProtocol
+	p.Options = cfg.Options
 }
 
 type NodePoolDescription struct {
-	name        string
-	tcpPorts    []PortMapping
-	udpPorts    []PortMapping
-	selectors   []Selector
-	addressType corev1.NodeAddressType
+	name             string
+	ports            []PortMapping
+	selectors        []Selector
+	addressType      corev1.NodeAddressType
+	nodePortServices *NodePortServicesDescription
+	preferredZone    string
+	fallbackPools    []string
+	fallbackAsBackup bool
+	guard            *GuardDescription
 }
 
 func (n *NodePoolDescription) FromConfig(cfg *public.NodePoolConfigFile) error {
 	n.name = cfg.Name
-	n.tcpPorts = make([]PortMapping, len(cfg.TCPPorts))
-	for i, port := range cfg.TCPPorts {
-		(&n.tcpPorts[i]).FromConfig(port)
+	n.ports = make([]PortMapping, 0, len(cfg.TCPPorts)+len(cfg.UDPPorts))
+	for _, port := range cfg.TCPPorts {
+		mappings, err := PortMappingsFromConfig(port, corev1.ProtocolTCP)
+		if err != nil {
+			return err
+		}
+		n.ports = append(n.ports, mappings...)
 	}
-	n.udpPorts = make([]PortMapping, len(cfg.UDPPorts))
-	for i, port := range cfg.UDPPorts {
-		(&n.udpPorts[i]).FromConfig(port)
+	for _, port := range cfg.UDPPorts {
+		mappings, err := PortMappingsFromConfig(port, corev1.ProtocolUDP)
+		if err != nil {
+			return err
+		}
+		n.ports = append(n.ports, mappings...)
 	}
 	n.selectors = make([]Selector, len(cfg.NodeSelectors))
 	for i, selector := range cfg.NodeSelectors {
@@ -57,6 +184,26 @@ func (n *NodePoolDescription) FromConfig(cfg *public.NodePoolConfigFile) error {
 		}
 	}
 	n.addressType = cfg.AddressType
+	n.preferredZone = cfg.PreferredZone
+	for _, fallback := range cfg.FallbackPools {
+		if fallback == cfg.Name {
+			return fmt.Errorf("A pool cannot be its own fallback")
+		}
+	}
+	n.fallbackPools = cfg.FallbackPools
+	n.fallbackAsBackup = cfg.FallbackAsBackup
+	if cfg.Guard != nil {
+		n.guard = &GuardDescription{}
+		if err := n.guard.FromConfig(cfg.Guard); err != nil {
+			return fmt.Errorf("Invalid guard: %v", err)
+		}
+	}
+	if cfg.NodePortServices != nil {
+		n.nodePortServices = &NodePortServicesDescription{}
+		if err := n.nodePortServices.FromConfig(cfg.NodePortServices); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -66,68 +213,107 @@ type Selector struct {
 }
 
 type PoolWatcher struct {
-	kubernetesAPIs []corev1api.NodeInterface
+	kubernetesAPIs []kubernetes.Interface
 	pool           NodePoolDescription
+	// synced, if not nil, is called once the initial list has been sent
+	synced func()
+	// listOnly, if set, stops the watcher once the initial list has been sent, instead of watching for changes
+	listOnly bool
+}
+
+// selectorEvent is a watch event for the selector at an index of a pool's selectors
+type selectorEvent struct {
+	watch.Event
+	selector int
 }
 
-func (p *PoolWatcher) processNewNode(node *corev1.Node, events chan<- NodeEvent) {
-	fmt.Printf("New Node: %s, %s, %v, %v\n", node.Name, p.pool.addressType, node.Status.Addresses, p.pool.tcpPorts)
+func (p *PoolWatcher) processNode(node *corev1.Node, events chan<- NodeEvent) {
+	fmt.Printf("Node in pool %s: %s, %s, %v\n", p.pool.name, node.Name, p.pool.addressType, node.Status.Addresses)
+	addresses := make([]string, 0, len(node.Status.Addresses))
 	for _, address := range node.Status.Addresses {
 		if address.Type == p.pool.addressType {
-			for _, port := range p.pool.tcpPorts {
-				fmt.Printf("New TCP Port: %d->%s:%d\n", port.Source, address.Address, port.Dest)
-				events <- NodeEvent{
-					Type: watch.Added,
-					Port: Port{
-						TCP: &port.Source,
-					},
-					Address: address.Address,
-				}
-			}
-			for _, port := range p.pool.udpPorts {
-				fmt.Printf("New UDP Port: %d->%s:%d\n", port.Source, address.Address, port.Dest)
-				events <- NodeEvent{
-					Type: watch.Added,
-					Port: Port{
-						UDP: &port.Source,
-					},
-					Address: address.Address,
-				}
-			}
+			addresses = append(addresses, address.Address)
 		}
 	}
-	// TODO: If no events are generated, log a message saying so, and to double check the ports and address types
+	if len(addresses) == 0 {
+		fmt.Printf("Node %s has no addresses of type %s, it will not receive traffic for pool %s\n", node.Name, p.pool.addressType, p.pool.name)
+	}
+	events <- NodeEvent{
+		Type:      watch.Modified,
+		Pool:      p.pool.name,
+		Node:      node.Name,
+		Addresses: addresses,
+		Zone:      nodeZone(node),
+	}
+}
+
+// nodeZone returns the topology zone of a node, or empty if it has none
+func nodeZone(node *corev1.Node) string {
+	if zone, ok := node.Labels[corev1.LabelTopologyZone]; ok {
+		return zone
+	}
+	return node.Labels[corev1.LabelFailureDomainBetaZone]
+}
+
+// match records that a node matches a selector, and sends its current addresses
+func (p *PoolWatcher) match(matches map[string]map[int]struct{}, selector int, node *corev1.Node, events chan<- NodeEvent) {
+	if _, ok := matches[node.Name]; !ok {
+		matches[node.Name] = make(map[int]struct{})
+	}
+	matches[node.Name][selector] = struct{}{}
+	p.processNode(node, events)
+}
 
+// unmatch records that a node no longer matches a selector, and removes it from the pool if it no longer matches any selector
+func (p *PoolWatcher) unmatch(matches map[string]map[int]struct{}, selector int, node *corev1.Node, events chan<- NodeEvent) {
+	delete(matches[node.Name], selector)
+	if len(matches[node.Name]) != 0 {
+		return
+	}
+	delete(matches, node.Name)
+	fmt.Printf("Node left pool %s: %s\n", p.pool.name, node.Name)
+	events <- NodeEvent{
+		Type: watch.Deleted,
+		Pool: p.pool.name,
+		Node: node.Name,
+	}
 }
 
 func (p *PoolWatcher) Run(ctx context.Context, events chan<- NodeEvent, stop <-chan struct{}) error {
-	fmt.Printf("Starting watches for %#v\b", *p)
-	watchEvents := make(chan watch.Event)
-	defer close(watchEvents)
-	nodes := make(map[string]*corev1.Node)
+	fmt.Printf("Starting watches for %#v\n", p.pool)
+	watchEvents := make(chan selectorEvent)
+	watchEnded := make(chan error, 1)
 	initialList := make([][]corev1.Node, 0, len(p.pool.selectors))
 	for _, api := range p.kubernetesAPIs {
 		for i, selector := range p.pool.selectors {
 			fmt.Printf("Getting initial list of nodes for pool %s: --selector=%s --fieldSelector=%s\n", p.pool.name, selector.labelSelector, selector.fieldSelector)
 			options := metav1.ListOptions{LabelSelector: selector.labelSelector, FieldSelector: selector.fieldSelector}
 			if i >= len(initialList) {
-				nodes, err := api.List(ctx, options)
+				nodes, err := api.CoreV1().Nodes().List(ctx, options)
 				if err != nil {
 					fmt.Printf("Listing nodes failed: %v\n", err)
 					continue // Maybe another call will succeed?
 				}
 				initialList = append(initialList, nodes.Items)
 			}
-			watcher, err := api.Watch(ctx, options)
+			if p.listOnly {
+				continue
+			}
+			watcher, err := api.CoreV1().Nodes().Watch(ctx, options)
 			if err != nil {
 				return err
 			}
 			defer watcher.Stop()
-			go func() {
-				for event := range watcher.ResultChan() {
-					watchEvents <- event
-				}
-			}()
+			go func(selector int) {
+				forwardWatch(fmt.Sprintf("nodes for pool %s", p.pool.name), watcher, func(event watch.Event) bool {
+					select {
+					case watchEvents <- selectorEvent{Event: event, selector: selector}:
+						return true
+					case <-stop:
+						return false
+					}
+				}, watchEnded)
+			}(i)
 		}
 	}
 
@@ -135,32 +321,38 @@ func (p *PoolWatcher) Run(ctx context.Context, events chan<- NodeEvent, stop <-c
 		return fmt.Errorf("Did not get an initial list for all selectors")
 	}
 
-	initialProcessedNodeNames := make(map[string]struct{})
-	for _, nodes := range initialList {
+	// A node may match more than one selector, so track which ones it matches in order to
+	// only remove it from the pool once it matches none of them
+	matches := make(map[string]map[int]struct{})
+	for i, nodes := range initialList {
 		for _, node := range nodes {
-			if _, ok := initialProcessedNodeNames[node.Name]; ok {
-				continue
-			}
-			initialProcessedNodeNames[node.Name] = struct{}{}
-			p.processNewNode(&node, events)
+			p.match(matches, i, &node, events)
 		}
 	}
+	notifySynced(p.synced)
+	if p.listOnly {
+		return nil
+	}
 
 	running := true
 
 	for running {
 		select {
 		case watchEvent := <-watchEvents:
-			node := watchEvent.Object.(*corev1.Node)
+			node, ok := watchEvent.Object.(*corev1.Node)
+			if !ok {
+				// TODO: Pass error
+				fmt.Printf("Unexpected watch event for pool %s: %#v\n", p.pool.name, watchEvent.Event)
+				continue
+			}
 			switch watchEvent.Type {
-			case watch.Added:
-				nodes[node.Name] = node
-				p.processNewNode(node, events)
-				// TODO: Handle remaining types
-				// Deleted: Send delete event for last known set of addresses for each port
-				// Modified: Compare new addresses vs last known addresses, send added/deleted as necessary
-				// Error: Pass error
+			case watch.Added, watch.Modified:
+				p.match(matches, watchEvent.selector, node, events)
+			case watch.Deleted:
+				p.unmatch(matches, watchEvent.selector, node, events)
 			}
+		case err := <-watchEnded:
+			return err
 		case <-stop:
 			running = false
 		}
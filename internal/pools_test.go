@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestPortMappingsFromConfig(t *testing.T) {
+	dest := 8080
+	outOfRange := 70000
+	maxFails := 3
+	cases := []struct {
+		name     string
+		cfg      public.PortMapping
+		protocol corev1.Protocol
+		want     []PortMapping
+		wantErr  bool
+	}{
+		{
+			name:     "single port",
+			cfg:      public.PortMapping{Source: public.PortRange{First: 80, Last: 80}},
+			protocol: corev1.ProtocolTCP,
+			want: []PortMapping{
+				{Source: 80, Dest: 80, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 80, Last: 80}},
+			},
+		},
+		{
+			name:     "dest",
+			cfg:      public.PortMapping{Source: public.PortRange{First: 80, Last: 80}, Dest: &dest},
+			protocol: corev1.ProtocolUDP,
+			want: []PortMapping{
+				{Source: 80, Dest: 8080, Protocol: corev1.ProtocolUDP, Range: public.PortRange{First: 80, Last: 80}},
+			},
+		},
+		{
+			name:     "range with offset",
+			cfg:      public.PortMapping{Source: public.PortRange{First: 30000, Last: 30002}, Offset: 1000},
+			protocol: corev1.ProtocolTCP,
+			want: []PortMapping{
+				{Source: 30000, Dest: 31000, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 30000, Last: 30002}},
+				{Source: 30001, Dest: 31001, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 30000, Last: 30002}},
+				{Source: 30002, Dest: 31002, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 30000, Last: 30002}},
+			},
+		},
+		{
+			name:     "listen address",
+			cfg:      public.PortMapping{Source: public.PortRange{First: 80, Last: 80}, ListenAddress: "10.0.0.1"},
+			protocol: corev1.ProtocolTCP,
+			want: []PortMapping{
+				{Source: 80, Dest: 80, Address: "10.0.0.1", Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 80, Last: 80}},
+			},
+		},
+		{
+			name: "options",
+			cfg: public.PortMapping{
+				Source: public.PortRange{First: 443, Last: 443},
+				PortOptions: public.PortOptions{
+					Algorithm:      "roundRobin",
+					ConnectTimeout: &metav1.Duration{Duration: 2 * time.Second},
+					IdleTimeout:    &metav1.Duration{Duration: 10 * time.Minute},
+					MaxFails:       &maxFails,
+					ProxyProtocol:  true,
+					Options:        map[string]string{"weight": "2"},
+				},
+			},
+			protocol: corev1.ProtocolTCP,
+			want: []PortMapping{
+				{
+					Source:      443,
+					Dest:        443,
+					Protocol:    corev1.ProtocolTCP,
+					Range:       public.PortRange{First: 443, Last: 443},
+					PortOptions: PortOptions{Algorithm: "roundRobin", ConnectTimeout: 2 * time.Second, IdleTimeout: 10 * time.Minute, MaxFails: &maxFails, ProxyProtocol: true, Options: map[string]string{"weight": "2"}},
+				},
+			},
+		},
+		{
+			name:     "local service",
+			cfg:      public.PortMapping{Source: public.PortRange{First: 443, Last: 443}, LocalService: &public.ServiceReference{Namespace: "ingress-nginx", Name: "ingress"}},
+			protocol: corev1.ProtocolTCP,
+			want: []PortMapping{
+				{Source: 443, Dest: 443, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 443, Last: 443}, LocalService: "ingress-nginx/ingress"},
+			},
+		},
+		{
+			name:     "local service in the default namespace",
+			cfg:      public.PortMapping{Source: public.PortRange{First: 443, Last: 443}, LocalService: &public.ServiceReference{Name: "ingress"}},
+			protocol: corev1.ProtocolTCP,
+			want: []PortMapping{
+				{Source: 443, Dest: 443, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 443, Last: 443}, LocalService: "default/ingress"},
+			},
+		},
+		{
+			name:    "range with dest",
+			cfg:     public.PortMapping{Source: public.PortRange{First: 80, Last: 81}, Dest: &dest},
+			wantErr: true,
+		},
+		{
+			name:    "dest and offset",
+			cfg:     public.PortMapping{Source: public.PortRange{First: 80, Last: 80}, Dest: &dest, Offset: 1},
+			wantErr: true,
+		},
+		{
+			name:    "dest out of range",
+			cfg:     public.PortMapping{Source: public.PortRange{First: 80, Last: 80}, Dest: &outOfRange},
+			wantErr: true,
+		},
+		{
+			name:    "offset out of range",
+			cfg:     public.PortMapping{Source: public.PortRange{First: 65535, Last: 65535}, Offset: 1},
+			wantErr: true,
+		},
+		{
+			name:    "reversed range",
+			cfg:     public.PortMapping{Source: public.PortRange{First: 81, Last: 80}},
+			wantErr: true,
+		},
+		{
+			name:    "local service with no name",
+			cfg:     public.PortMapping{Source: public.PortRange{First: 80, Last: 80}, LocalService: &public.ServiceReference{Namespace: "default"}},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := PortMappingsFromConfig(c.cfg, c.protocol)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPortPoolsRender(t *testing.T) {
+	tcp := func(address string, port int) Listener {
+		return Listener{Address: address, Protocol: corev1.ProtocolTCP, Port: port}
+	}
+	cases := []struct {
+		name  string
+		pools portPools
+		want  []PortVars
+	}{
+		{
+			name:  "empty",
+			pools: portPools{},
+			want:  []PortVars{},
+		},
+		{
+			name: "sorted by port then address",
+			pools: portPools{
+				tcp("", 443):                             {pool: "workers", addresses: map[string]string{"10.0.0.2": "", "10.0.0.1": ""}, destPort: 30443, sourceRange: public.PortRange{First: 443, Last: 443}},
+				tcp("10.0.0.10", 80):                     {pool: "workers", addresses: map[string]string{"10.0.0.1": ""}, destPort: 30080, sourceRange: public.PortRange{First: 80, Last: 80}},
+				tcp("", 80):                              {pool: "workers", addresses: map[string]string{"10.0.0.1": ""}, destPort: 30080, sourceRange: public.PortRange{First: 80, Last: 80}},
+				{Protocol: corev1.ProtocolUDP, Port: 53}: {pool: "workers", addresses: map[string]string{"10.0.0.1": ""}, destPort: 30053, sourceRange: public.PortRange{First: 53, Last: 53}},
+			},
+			want: []PortVars{
+				{Name: "tcp_80", Pool: "workers", Protocol: "tcp", SourcePort: 80, SourcePortEnd: 80, DestPort: 30080, DestPortEnd: 30080, Addresses: []string{"10.0.0.1"}, Zones: []ZoneVars{{Addresses: []string{"10.0.0.1"}}}},
+				{Name: "tcp_10_0_0_10_80", Pool: "workers", Protocol: "tcp", ListenAddress: "10.0.0.10", SourcePort: 80, SourcePortEnd: 80, DestPort: 30080, DestPortEnd: 30080, Addresses: []string{"10.0.0.1"}, Zones: []ZoneVars{{Addresses: []string{"10.0.0.1"}}}},
+				{Name: "tcp_443", Pool: "workers", Protocol: "tcp", SourcePort: 443, SourcePortEnd: 443, DestPort: 30443, DestPortEnd: 30443, Addresses: []string{"10.0.0.1", "10.0.0.2"}, Zones: []ZoneVars{{Addresses: []string{"10.0.0.1", "10.0.0.2"}}}},
+			},
+		},
+		{
+			name: "range is collapsed",
+			pools: portPools{
+				tcp("", 30000): {pool: "workers", addresses: map[string]string{"10.0.0.1": ""}, destPort: 31000, sourceRange: public.PortRange{First: 30000, Last: 30001}},
+				tcp("", 30001): {pool: "workers", addresses: map[string]string{"10.0.0.2": ""}, destPort: 31001, sourceRange: public.PortRange{First: 30000, Last: 30001}},
+			},
+			want: []PortVars{
+				{Name: "tcp_30000_30001", Pool: "workers", Protocol: "tcp", SourcePort: 30000, SourcePortEnd: 30001, DestPort: 31000, DestPortEnd: 31001, Addresses: []string{"10.0.0.1", "10.0.0.2"}, Zones: []ZoneVars{{Addresses: []string{"10.0.0.1", "10.0.0.2"}}}},
+			},
+		},
+		{
+			name: "options",
+			pools: portPools{
+				tcp("", 80): {pool: "workers", addresses: map[string]string{"10.0.0.1": ""}, destPort: 30080, sourceRange: public.PortRange{First: 80, Last: 80}, options: PortOptions{Algorithm: "random", ProxyProtocol: true}},
+			},
+			want: []PortVars{
+				{Name: "tcp_80", Pool: "workers", Protocol: "tcp", SourcePort: 80, SourcePortEnd: 80, DestPort: 30080, DestPortEnd: 30080, Addresses: []string{"10.0.0.1"}, Zones: []ZoneVars{{Addresses: []string{"10.0.0.1"}}}, PortOptions: PortOptions{Algorithm: "random", ProxyProtocol: true}},
+			},
+		},
+		{
+			name: "preferred zone",
+			pools: portPools{
+				tcp("", 80): {pool: "workers", addresses: map[string]string{"10.0.0.1": "a", "10.0.0.2": "b", "10.0.0.3": "a"}, destPort: 30080, sourceRange: public.PortRange{First: 80, Last: 80}, preferredZone: "a"},
+			},
+			want: []PortVars{
+				{
+					Name:            "tcp_80",
+					Pool:            "workers",
+					Protocol:        "tcp",
+					SourcePort:      80,
+					SourcePortEnd:   80,
+					DestPort:        30080,
+					DestPortEnd:     30080,
+					Addresses:       []string{"10.0.0.1", "10.0.0.3"},
+					BackupAddresses: []string{"10.0.0.2"},
+					Zones:           []ZoneVars{{Zone: "a", Addresses: []string{"10.0.0.1", "10.0.0.3"}}, {Zone: "b", Addresses: []string{"10.0.0.2"}}},
+				},
+			},
+		},
+		{
+			name: "preferred zone and fallbacks",
+			pools: portPools{
+				tcp("", 80): {
+					pool:            "workers",
+					addresses:       map[string]string{"10.0.0.1": "a", "10.0.0.2": "b"},
+					backupAddresses: map[string]string{"10.0.1.1": "a", "10.0.0.2": "b"},
+					destPort:        30080,
+					sourceRange:     public.PortRange{First: 80, Last: 80},
+					preferredZone:   "a",
+				},
+			},
+			want: []PortVars{
+				{
+					Name:            "tcp_80",
+					Pool:            "workers",
+					Protocol:        "tcp",
+					SourcePort:      80,
+					SourcePortEnd:   80,
+					DestPort:        30080,
+					DestPortEnd:     30080,
+					Addresses:       []string{"10.0.0.1"},
+					BackupAddresses: []string{"10.0.0.2", "10.0.1.1"},
+					Zones:           []ZoneVars{{Zone: "a", Addresses: []string{"10.0.0.1"}}, {Zone: "b", Addresses: []string{"10.0.0.2"}}},
+				},
+			},
+		},
+		{
+			name: "no nodes in preferred zone",
+			pools: portPools{
+				tcp("", 80): {pool: "workers", addresses: map[string]string{"10.0.0.2": "b", "10.0.0.4": ""}, destPort: 30080, sourceRange: public.PortRange{First: 80, Last: 80}, preferredZone: "a"},
+			},
+			want: []PortVars{
+				{Name: "tcp_80", Pool: "workers", Protocol: "tcp", SourcePort: 80, SourcePortEnd: 80, DestPort: 30080, DestPortEnd: 30080, Addresses: []string{"10.0.0.2", "10.0.0.4"}, Zones: []ZoneVars{{Addresses: []string{"10.0.0.4"}}, {Zone: "b", Addresses: []string{"10.0.0.2"}}}},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.pools.render(corev1.ProtocolTCP)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPortVarsRange(t *testing.T) {
+	cases := []struct {
+		name       string
+		port       PortVars
+		wantListen string
+		wantPorts  []PortPair
+	}{
+		{
+			name:       "single port",
+			port:       PortVars{SourcePort: 80, SourcePortEnd: 80, DestPort: 30080, DestPortEnd: 30080},
+			wantListen: "80",
+			wantPorts:  []PortPair{{SourcePort: 80, DestPort: 30080}},
+		},
+		{
+			name:       "range",
+			port:       PortVars{ListenAddress: "10.0.0.1", SourcePort: 30000, SourcePortEnd: 30002, DestPort: 31000, DestPortEnd: 31002},
+			wantListen: "10.0.0.1:30000-30002",
+			wantPorts:  []PortPair{{SourcePort: 30000, DestPort: 31000}, {SourcePort: 30001, DestPort: 31001}, {SourcePort: 30002, DestPort: 31002}},
+		},
+		{
+			name:       "IPv6 address",
+			port:       PortVars{ListenAddress: "fd00::1", SourcePort: 80, SourcePortEnd: 81, DestPort: 80, DestPortEnd: 81},
+			wantListen: "[fd00::1]:80-81",
+			wantPorts:  []PortPair{{SourcePort: 80, DestPort: 80}, {SourcePort: 81, DestPort: 81}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.port.Listen(); got != c.wantListen {
+				t.Errorf("Got listen %q, want %q", got, c.wantListen)
+			}
+			if got := c.port.Ports(); !reflect.DeepEqual(got, c.wantPorts) {
+				t.Errorf("Got ports %v, want %v", got, c.wantPorts)
+			}
+		})
+	}
+}
+
+func TestNodeZone(t *testing.T) {
+	cases := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "no zone"},
+		{name: "zone", labels: map[string]string{corev1.LabelTopologyZone: "a"}, want: "a"},
+		{name: "deprecated zone", labels: map[string]string{corev1.LabelFailureDomainBetaZone: "b"}, want: "b"},
+		{name: "zone takes precedence", labels: map[string]string{corev1.LabelTopologyZone: "a", corev1.LabelFailureDomainBetaZone: "b"}, want: "a"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := nodeZone(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: c.labels}}); got != c.want {
+				t.Errorf("Got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestListenerName(t *testing.T) {
+	cases := []struct {
+		listener Listener
+		want     string
+	}{
+		{listener: Listener{Protocol: corev1.ProtocolTCP, Port: 80}, want: "tcp_80"},
+		{listener: Listener{Address: "10.0.0.1", Protocol: corev1.ProtocolUDP, Port: 53}, want: "udp_10_0_0_1_53"},
+		{listener: Listener{Address: "fd00::1", Protocol: corev1.ProtocolTCP, Port: 443}, want: "tcp_fd00__1_443"},
+	}
+	for _, c := range cases {
+		t.Run(c.listener.String(), func(t *testing.T) {
+			if got := c.listener.Name(); got != c.want {
+				t.Errorf("Got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateListeners(t *testing.T) {
+	pool := func(name string, ports ...PortMapping) NodePoolDescription {
+		return NodePoolDescription{name: name, ports: ports}
+	}
+	tcp := func(address string, port int) PortMapping {
+		return PortMapping{Source: port, Dest: port, Address: address, Protocol: corev1.ProtocolTCP}
+	}
+	cases := []struct {
+		name    string
+		pools   []NodePoolDescription
+		wantErr bool
+	}{
+		{name: "different ports", pools: []NodePoolDescription{pool("a", tcp("", 80)), pool("b", tcp("", 443))}},
+		{name: "different addresses", pools: []NodePoolDescription{pool("a", tcp("10.0.0.1", 80)), pool("b", tcp("10.0.0.2", 80))}},
+		{name: "different protocols", pools: []NodePoolDescription{pool("a", tcp("", 53), PortMapping{Source: 53, Dest: 53, Protocol: corev1.ProtocolUDP})}},
+		{name: "IPv4 and IPv6 wildcards", pools: []NodePoolDescription{pool("a", tcp("", 80)), pool("b", tcp("::", 80))}},
+		{name: "same port", pools: []NodePoolDescription{pool("a", tcp("", 80)), pool("b", tcp("", 80))}, wantErr: true},
+		{name: "same port in one pool", pools: []NodePoolDescription{pool("a", tcp("10.0.0.1", 80), tcp("10.0.0.1", 80))}, wantErr: true},
+		{name: "IPv4 wildcard spelled out", pools: []NodePoolDescription{pool("a", tcp("", 80)), pool("b", tcp("0.0.0.0", 80))}, wantErr: true},
+		{name: "same IPv6 address spelled differently", pools: []NodePoolDescription{pool("a", tcp("fd00::1", 80)), pool("b", tcp("fd00:0::1", 80))}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateListeners(c.pools, nil)
+			if c.wantErr && err == nil {
+				t.Error("Expected an error")
+			}
+			if !c.wantErr && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
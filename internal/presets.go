@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+//go:embed presets
+var presetFiles embed.FS
+
+// DefaultNodePoolsPreset is the node pools preset used if none is selected
+const DefaultNodePoolsPreset = "default"
+
+// DefaultTemplatePreset is the template preset used if no templates are configured
+const DefaultTemplatePreset = "nginx"
+
+// TemplatePreset is a built-in gotpl template
+type TemplatePreset struct {
+	// File is the embedded file containing the template
+	File string
+	// Path is where the file is written if the template does not set one
+	Path string
+	// Parameters are the parameters the template uses as .Params, and their default values
+	Parameters map[string]string
+	// Backend is the load balancer the template configures, which selects what lbAlgorithm names each algorithm, or empty if it does not use algorithms
+	Backend string
+	// Validate checks the parameters of the template, if set, given whether any port has a listen address
+	Validate func(params map[string]string, hasListenAddress bool) error
+}
+
+// TemplatePresets are the built-in templates, by name
+var TemplatePresets = map[string]TemplatePreset{
+	"nginx": {
+		File: "presets/nginx.conf.tpl",
+		Path: "/etc/nginx/nginx.conf",
+		Parameters: map[string]string{
+			"workerProcesses":   "auto",
+			"workerConnections": "1024",
+			"pidFile":           "/run/nginx.pid",
+			"errorLog":          "/var/log/nginx/error.log",
+			"algorithm":         "leastConn",
+			"connectTimeout":    "1s",
+			"idleTimeout":       "10m",
+		},
+		Backend: "nginx",
+	},
+	"haproxy": {
+		File: "presets/haproxy.cfg.tpl",
+		Path: "/etc/haproxy/haproxy.cfg",
+		Parameters: map[string]string{
+			"maxconn":        "4096",
+			"algorithm":      "leastConn",
+			"connectTimeout": "1s",
+			"idleTimeout":    "10m",
+			"statsPort":      "",
+		},
+		Backend: "haproxy",
+	},
+	"envoy": {
+		File: "presets/envoy.yaml.tpl",
+		Path: "/etc/envoy/envoy.yaml",
+		Parameters: map[string]string{
+			"algorithm":      "leastConn",
+			"connectTimeout": "1s",
+			"idleTimeout":    "600s",
+			"adminPort":      "9901",
+		},
+		Backend: "envoy",
+	},
+	"traefik": {
+		File: "presets/traefik.yaml.tpl",
+		Path: "/etc/traefik/dynamic/doorman.yaml",
+		Parameters: map[string]string{
+			"entryPointPrefix": "doorman_",
+		},
+	},
+	"keepalived": {
+		File: "presets/keepalived.conf.tpl",
+		Path: "/etc/keepalived/keepalived.conf",
+		Parameters: map[string]string{
+			"routerID":        "doorman",
+			"virtualIP":       "",
+			"interface":       "eth0",
+			"state":           "BACKUP",
+			"virtualRouterID": "51",
+			"priority":        "100",
+			"algorithm":       "leastConn",
+			"kind":            "NAT",
+			"connectTimeout":  "3",
+		},
+		Backend: "keepalived",
+		Validate: func(params map[string]string, hasListenAddress bool) error {
+			if params["virtualIP"] == "" && !hasListenAddress {
+				return fmt.Errorf("The virtualIP parameter must be set if no port has a listen address")
+			}
+			return nil
+		},
+	},
+}
+
+// Algorithms are the load balancing algorithms accepted by the presets, and what each backend calls them.
+// An empty name means the backend's default, and a missing one means the backend does not support the algorithm.
+var Algorithms = map[string]map[string]string{
+	"roundRobin": {"nginx": "", "haproxy": "roundrobin", "envoy": "ROUND_ROBIN", "keepalived": "rr"},
+	"leastConn":  {"nginx": "least_conn", "haproxy": "leastconn", "envoy": "LEAST_REQUEST", "keepalived": "lc"},
+	"random":     {"nginx": "random", "haproxy": "random", "envoy": "RANDOM"},
+	"sourceHash": {"nginx": "hash $remote_addr consistent", "haproxy": "source", "keepalived": "sh"},
+}
+
+// lbAlgorithm returns what a backend calls a load balancing algorithm
+func lbAlgorithm(backend, algorithm string) (string, error) {
+	names, ok := Algorithms[algorithm]
+	if !ok {
+		algorithms := make([]string, 0, len(Algorithms))
+		for algorithm := range Algorithms {
+			algorithms = append(algorithms, algorithm)
+		}
+		sort.Strings(algorithms)
+		return "", fmt.Errorf("Unrecognized algorithm %q, must be one of %v", algorithm, algorithms)
+	}
+	name, ok := names[backend]
+	if !ok {
+		return "", fmt.Errorf("Algorithm %s is not supported by %s", algorithm, backend)
+	}
+	return name, nil
+}
+
+// params returns the parameters of the preset, with any of them overridden
+func (t TemplatePreset) params(overrides map[string]string) (map[string]string, error) {
+	params := make(map[string]string, len(t.Parameters))
+	for name, value := range t.Parameters {
+		params[name] = value
+	}
+	for name, value := range overrides {
+		if _, ok := t.Parameters[name]; !ok {
+			names := make([]string, 0, len(t.Parameters))
+			for name := range t.Parameters {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Unrecognized parameter %s, must be one of %v", name, names)
+		}
+		params[name] = value
+	}
+	return params, nil
+}
+
+// Template returns the contents of the preset's template
+func (t TemplatePreset) Template() (string, error) {
+	data, err := presetFiles.ReadFile(t.File)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// NodePoolsPreset returns the built-in node pools with a name
+func NodePoolsPreset(name string) ([]public.NodePoolConfigFile, error) {
+	data, err := presetFiles.ReadFile(path.Join("presets/pools", name+".yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("No such node pools preset %q, must be one of %v", name, NodePoolsPresets())
+	}
+	var pools []public.NodePoolConfigFile
+	if err := yaml.Unmarshal(data, &pools); err != nil {
+		return nil, fmt.Errorf("Invalid node pools preset %q: %v", name, err)
+	}
+	return pools, nil
+}
+
+// NodePoolsPresets returns the names of the built-in node pools
+func NodePoolsPresets() []string {
+	entries, _ := presetFiles.ReadDir("presets/pools")
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".yaml"))
+	}
+	return names
+}
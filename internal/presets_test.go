@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestTemplatePresets(t *testing.T) {
+	maxFails := 2
+	templateVars := TemplateVars{
+		TCPPorts: []PortVars{
+			{Name: "tcp_80", Pool: "workers", Protocol: "tcp", SourcePort: 80, SourcePortEnd: 80, DestPort: 30080, DestPortEnd: 30080, Addresses: []string{"10.0.0.1", "fd00::1"}, BackupAddresses: []string{"10.0.1.1"}, PortOptions: PortOptions{MaxFails: &maxFails, ProxyProtocol: true}},
+			{Name: "tcp_10_0_0_10_30000_30001", Pool: "workers", Protocol: "tcp", ListenAddress: "10.0.0.10", SourcePort: 30000, SourcePortEnd: 30001, DestPort: 31000, DestPortEnd: 31001, Addresses: []string{"10.0.0.1"}, PortOptions: PortOptions{Algorithm: "roundRobin", ConnectTimeout: 1500 * time.Millisecond}},
+			{Name: "tcp_443", Pool: "workers", Protocol: "tcp", SourcePort: 443, SourcePortEnd: 443, DestPort: 30443, DestPortEnd: 30443},
+		},
+		UDPPorts: []PortVars{
+			{Name: "udp_53", Pool: "workers", Protocol: "udp", SourcePort: 53, SourcePortEnd: 53, DestPort: 30053, DestPortEnd: 30053, Addresses: []string{"10.0.0.1"}, PortOptions: PortOptions{Algorithm: "roundRobin"}},
+		},
+	}
+	cases := []struct {
+		preset     string
+		parameters map[string]string
+		want       []string
+	}{
+		{
+			preset: "nginx",
+			want: []string{
+				"upstream doorman_tcp_80 {\n        least_conn;\n        server 10.0.0.1:30080 max_fails=2;\n        server [fd00::1]:30080 max_fails=2;\n        server 10.0.1.1:30080 max_fails=2 backup;\n    }",
+				// Round robin is the default, so has no directive
+				"upstream doorman_tcp_10_0_0_10_30000_30001_30001 {\n        server 10.0.0.1:31001;\n    }",
+				"listen 10.0.0.10:30000-30001;",
+				"proxy_pass doorman_tcp_10_0_0_10_30000_30001_$server_port;",
+				"proxy_connect_timeout 1500ms;",
+				"proxy_protocol on;",
+				"# No nodes for tcp 443",
+				"upstream doorman_udp_53 {\n        server 10.0.0.1:30053;",
+				"listen 53 udp;",
+			},
+		},
+		{
+			preset:     "haproxy",
+			parameters: map[string]string{"statsPort": "8404"},
+			want: []string{
+				"bind :8404",
+				"backend doorman_tcp_80\n    balance leastconn",
+				"server server1 [fd00::1]:30080 check fall 2 send-proxy",
+				"server backup0 10.0.1.1:30080 check backup fall 2 send-proxy",
+				"bind 10.0.0.10:30000-30001",
+				"balance roundrobin",
+				"timeout connect 1500ms",
+				// A range forwards to a relative port, so is checked on its first destination port
+				"server server0 10.0.0.1:+1000 check port 31000",
+				"# No nodes for tcp 443",
+				"# UDP is not supported by HAProxy, not load balancing udp 53",
+			},
+		},
+		{
+			preset: "envoy",
+			want: []string{
+				"lb_policy: LEAST_REQUEST",
+				"lb_policy: ROUND_ROBIN",
+				"connect_timeout: 1.500s",
+				"- name: doorman_tcp_10_0_0_10_30000_30001_30001\n    address:\n      socket_address:\n        address: \"10.0.0.10\"\n        port_value: 30001",
+				"address: \"fd00::1\"",
+				"envoy.transport_sockets.upstream_proxy_protocol",
+			},
+		},
+		{
+			preset: "traefik",
+			want: []string{
+				"doorman_tcp_80:\n      entryPoints:\n      - doorman_tcp_80",
+				"- address: \"[fd00::1]:30080\"",
+				"doorman_tcp_10_0_0_10_30000_30001_30001:",
+			},
+		},
+		{
+			preset:     "keepalived",
+			parameters: map[string]string{"virtualIP": "192.168.1.20/24"},
+			want: []string{
+				"virtual_ipaddress {\n        192.168.1.20/24\n    }",
+				"virtual_server 192.168.1.20 80 {\n    delay_loop 6\n    lb_algo lc",
+				"sorry_server 10.0.1.1 30080",
+				"virtual_server 10.0.0.10 30001 {\n    delay_loop 6\n    lb_algo rr",
+				"real_server 10.0.0.1 31001 {",
+				"# No nodes for tcp 443",
+				"virtual_server 192.168.1.20 53 {\n    delay_loop 6\n    lb_algo rr",
+			},
+		},
+	}
+	presets := make([]string, 0, len(TemplatePresets))
+	for preset := range TemplatePresets {
+		presets = append(presets, preset)
+	}
+	sort.Strings(presets)
+	tested := make([]string, 0, len(cases))
+	for _, c := range cases {
+		tested = append(tested, c.preset)
+	}
+	sort.Strings(tested)
+	if strings.Join(presets, ",") != strings.Join(tested, ",") {
+		t.Errorf("Presets %v are not all tested, only %v", presets, tested)
+	}
+	for _, c := range cases {
+		t.Run(c.preset, func(t *testing.T) {
+			var m ManagedFile
+			if err := m.FromConfig(&public.Template{Preset: c.preset, Parameters: c.parameters}); err != nil {
+				t.Fatal(err)
+			}
+			if m.path != TemplatePresets[c.preset].Path {
+				t.Errorf("Got path %s, want the default %s", m.path, TemplatePresets[c.preset].Path)
+			}
+			data, err := m.templater.Render(context.Background(), m.path, m.renderVars(templateVars, MetaVars{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range c.want {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("Rendered template does not contain %q:\n%s", want, data)
+				}
+			}
+		})
+	}
+}
+
+func TestNodePoolsPresets(t *testing.T) {
+	for _, name := range NodePoolsPresets() {
+		t.Run(name, func(t *testing.T) {
+			pools, err := NodePoolsPreset(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports := make(map[int]string)
+			for _, cfg := range pools {
+				var pool NodePoolDescription
+				if err := pool.FromConfig(&cfg); err != nil {
+					t.Fatalf("Invalid node pool %s: %v", cfg.Name, err)
+				}
+				for _, port := range pool.ports {
+					ports[port.Source] = pool.name
+				}
+			}
+			// The API server is load balanced to the control plane, and HTTP(S) to the workers
+			for port, pool := range map[int]string{6443: "control-plane", 80: "worker", 443: "worker"} {
+				if ports[port] != pool {
+					t.Errorf("Port %d is in pool %q, want %s", port, ports[port], pool)
+				}
+			}
+		})
+	}
+	if _, err := NodePoolsPreset("openshift"); err == nil {
+		t.Error("Expected an error for an unrecognized preset")
+	}
+}
+
+func TestValidatePresets(t *testing.T) {
+	port := func(algorithm, address string) PortMapping {
+		return PortMapping{Source: 80, Dest: 30080, Address: address, PortOptions: PortOptions{Algorithm: algorithm}}
+	}
+	cases := []struct {
+		name       string
+		preset     string
+		parameters map[string]string
+		ports      []PortMapping
+		wantErr    bool
+	}{
+		{name: "defaults", preset: "nginx"},
+		{name: "portable algorithm", preset: "haproxy", ports: []PortMapping{port("sourceHash", "")}},
+		{name: "backend algorithm", preset: "haproxy", ports: []PortMapping{port("leastconn", "")}, wantErr: true},
+		{name: "unsupported algorithm", preset: "envoy", ports: []PortMapping{port("sourceHash", "")}, wantErr: true},
+		{name: "unsupported algorithm parameter", preset: "keepalived", parameters: map[string]string{"algorithm": "random", "virtualIP": "192.168.1.20/24"}, wantErr: true},
+		{name: "algorithms not used", preset: "traefik", ports: []PortMapping{port("weighted", "")}},
+		{name: "keepalived without a virtual IP", preset: "keepalived", ports: []PortMapping{port("", "")}, wantErr: true},
+		{name: "keepalived with a virtual IP", preset: "keepalived", parameters: map[string]string{"virtualIP": "192.168.1.20/24"}, ports: []PortMapping{port("", "")}},
+		{name: "keepalived with a listen address", preset: "keepalived", ports: []PortMapping{port("", "192.168.1.10")}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := Doorman{
+				nodePools: []NodePoolDescription{{name: "workers", ports: c.ports}},
+				templates: make([]ManagedFile, 1),
+			}
+			if err := d.templates[0].FromConfig(&public.Template{Preset: c.preset, Parameters: c.parameters}); err != nil {
+				t.Fatal(err)
+			}
+			err := d.validatePresets()
+			if c.wantErr && err == nil {
+				t.Error("Expected an error")
+			}
+			if !c.wantErr && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
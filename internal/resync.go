@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// diffAddresses returns the addresses which are only in a and only in b
+func diffAddresses(a, b []string) ([]string, []string) {
+	inA := make(map[string]struct{}, len(a))
+	for _, address := range a {
+		inA[address] = struct{}{}
+	}
+	inB := make(map[string]struct{}, len(b))
+	for _, address := range b {
+		inB[address] = struct{}{}
+	}
+	onlyA := make([]string, 0)
+	for _, address := range a {
+		if _, ok := inB[address]; !ok {
+			onlyA = append(onlyA, address)
+		}
+	}
+	onlyB := make([]string, 0)
+	for _, address := range b {
+		if _, ok := inA[address]; !ok {
+			onlyB = append(onlyB, address)
+		}
+	}
+	return onlyA, onlyB
+}
+
+// diffPorts describes the differences between two sets of listeners
+func diffPorts(old, new []PortVars) []string {
+	changes := make([]string, 0)
+	oldPorts := make(map[string]PortVars, len(old))
+	for _, port := range old {
+		oldPorts[port.Name] = port
+	}
+	newPorts := make(map[string]PortVars, len(new))
+	for _, port := range new {
+		newPorts[port.Name] = port
+	}
+	for _, port := range old {
+		if _, ok := newPorts[port.Name]; !ok {
+			changes = append(changes, fmt.Sprintf("listener %s was removed", port.Name))
+		}
+	}
+	for _, port := range new {
+		oldPort, ok := oldPorts[port.Name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("listener %s was added with addresses %v", port.Name, port.Addresses))
+			continue
+		}
+		if reflect.DeepEqual(oldPort, port) {
+			continue
+		}
+		removed, added := diffAddresses(oldPort.Addresses, port.Addresses)
+		if len(removed) == 0 && len(added) == 0 {
+			changes = append(changes, fmt.Sprintf("listener %s changed", port.Name))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("listener %s added addresses %v and removed addresses %v", port.Name, added, removed))
+	}
+	return changes
+}
+
+// diffVars describes the differences between the template variables which were last rendered and those from a resync
+func diffVars(old, new TemplateVars) []string {
+	changes := append(diffPorts(old.TCPPorts, new.TCPPorts), diffPorts(old.UDPPorts, new.UDPPorts)...)
+	if !reflect.DeepEqual(old.HTTPHosts, new.HTTPHosts) {
+		changes = append(changes, "ingress hosts changed")
+	}
+	if !reflect.DeepEqual(old.TLSSecrets, new.TLSSecrets) {
+		changes = append(changes, "TLS secrets changed")
+	}
+	return changes
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffAddresses(t *testing.T) {
+	onlyA, onlyB := diffAddresses([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.2", "10.0.0.3"})
+	if !reflect.DeepEqual(onlyA, []string{"10.0.0.1"}) || !reflect.DeepEqual(onlyB, []string{"10.0.0.3"}) {
+		t.Errorf("Got %v and %v, want [10.0.0.1] and [10.0.0.3]", onlyA, onlyB)
+	}
+}
+
+func TestDiffVars(t *testing.T) {
+	port := func(name string, addresses ...string) PortVars {
+		return PortVars{Name: name, Protocol: "tcp", SourcePort: 80, DestPort: 30080, Addresses: addresses}
+	}
+	cases := []struct {
+		name string
+		old  TemplateVars
+		new  TemplateVars
+		want []string
+	}{
+		{
+			name: "no changes",
+			old:  TemplateVars{TCPPorts: []PortVars{port("tcp-80", "10.0.0.1")}},
+			new:  TemplateVars{TCPPorts: []PortVars{port("tcp-80", "10.0.0.1")}},
+			want: []string{},
+		},
+		{
+			name: "listeners added and removed",
+			old:  TemplateVars{TCPPorts: []PortVars{port("tcp-80", "10.0.0.1")}},
+			new:  TemplateVars{UDPPorts: []PortVars{port("udp-53", "10.0.0.1")}},
+			want: []string{"listener tcp-80 was removed", "listener udp-53 was added with addresses [10.0.0.1]"},
+		},
+		{
+			name: "addresses changed",
+			old:  TemplateVars{TCPPorts: []PortVars{port("tcp-80", "10.0.0.1", "10.0.0.2")}},
+			new:  TemplateVars{TCPPorts: []PortVars{port("tcp-80", "10.0.0.2", "10.0.0.3")}},
+			want: []string{"listener tcp-80 added addresses [10.0.0.3] and removed addresses [10.0.0.1]"},
+		},
+		{
+			name: "other fields changed",
+			old:  TemplateVars{TCPPorts: []PortVars{port("tcp-80", "10.0.0.1")}},
+			new:  TemplateVars{TCPPorts: []PortVars{{Name: "tcp-80", Protocol: "tcp", SourcePort: 80, DestPort: 30081, Addresses: []string{"10.0.0.1"}}}},
+			want: []string{"listener tcp-80 changed"},
+		},
+		{
+			name: "hosts and secrets changed",
+			old:  TemplateVars{},
+			new:  TemplateVars{HTTPHosts: []HostVars{{Host: "example.com"}}, TLSSecrets: []TLSSecretVars{{Secret: "default/tls"}}},
+			want: []string{"ingress hosts changed", "TLS secrets changed"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := diffVars(c.old, c.new); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"path/filepath"
+	"sort"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+type TLSSecretDescription struct {
+	namespace     string
+	name          string
+	certPath      string
+	keyPath       string
+	labelSelector string
+	directory     string
+}
+
+func (t *TLSSecretDescription) FromConfig(cfg *public.TLSSecretConfigFile) error {
+	if (cfg.Name == "") == (cfg.Labels == nil) {
+		return fmt.Errorf("Exactly one of name or labels is required")
+	}
+	if cfg.Name != "" {
+		if cfg.Namespace == "" {
+			return fmt.Errorf("A namespace is required with a name")
+		}
+		if cfg.CertPath == "" || cfg.KeyPath == "" {
+			return fmt.Errorf("certPath and keyPath are required with a name")
+		}
+		if cfg.CertPath == cfg.KeyPath {
+			return fmt.Errorf("certPath and keyPath must be different")
+		}
+	}
+	if cfg.Labels != nil {
+		if cfg.Directory == "" {
+			return fmt.Errorf("A directory is required with labels")
+		}
+		selector, err := metav1.LabelSelectorAsSelector(cfg.Labels)
+		if err != nil {
+			return err
+		}
+		t.labelSelector = selector.String()
+	}
+	t.namespace = cfg.Namespace
+	t.name = cfg.Name
+	t.certPath = cfg.CertPath
+	t.keyPath = cfg.KeyPath
+	t.directory = cfg.Directory
+	return nil
+}
+
+// paths returns the files to write the certificate and key of a secret to
+func (t *TLSSecretDescription) paths(secret *corev1.Secret) (string, string) {
+	if t.name != "" {
+		return t.certPath, t.keyPath
+	}
+	dir := filepath.Join(t.directory, secret.Namespace)
+	return filepath.Join(dir, secret.Name+".crt"), filepath.Join(dir, secret.Name+".key")
+}
+
+// TLSSecretWatcher writes the certificates and keys of TLS secrets to disk
+type TLSSecretWatcher struct {
+	kubernetesAPIs []kubernetes.Interface
+	secrets        TLSSecretDescription
+	// synced, if not nil, is called once the initial list has been sent
+	synced func()
+	// listOnly, if set, stops the watcher once the initial list has been sent, instead of watching for changes.
+	// The secrets are not written either, so that they are only ever written in the order they are watched.
+	listOnly bool
+}
+
+// writeSecret writes the certificate and key of a secret, returning true if either file changed
+func (t *TLSSecretWatcher) writeSecret(secret *corev1.Secret, certPath, keyPath string) (bool, error) {
+	cert, ok := secret.Data[corev1.TLSCertKey]
+	if !ok {
+		return false, fmt.Errorf("Missing %s", corev1.TLSCertKey)
+	}
+	key, ok := secret.Data[corev1.TLSPrivateKeyKey]
+	if !ok {
+		return false, fmt.Errorf("Missing %s", corev1.TLSPrivateKeyKey)
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return false, err
+		}
+	}
+	// Both files are written aside before either is replaced, so that a failure to write one does not leave the other from a different pair,
+	// and readers only see a mismatched pair in between the two renames
+	keyFile, err := stageFile(keyPath, key, defaultFileOptions(0600))
+	if err != nil {
+		return false, err
+	}
+	certFile, err := stageFile(certPath, cert, defaultFileOptions(0644))
+	if err != nil {
+		if keyFile != nil {
+			keyFile.discard()
+		}
+		return false, err
+	}
+	staged := make([]*stagedFile, 0, 2)
+	for _, file := range []*stagedFile{keyFile, certFile} {
+		if file != nil {
+			staged = append(staged, file)
+		}
+	}
+	for i, file := range staged {
+		if err := file.commit(); err != nil {
+			for _, rest := range staged[i+1:] {
+				rest.discard()
+			}
+			return false, err
+		}
+	}
+	return len(staged) != 0, nil
+}
+
+func (t *TLSSecretWatcher) processSecret(secret *corev1.Secret, events chan<- TLSSecretEvent) {
+	key := fmt.Sprintf("%s/%s", secret.Namespace, secret.Name)
+	certPath, keyPath := t.secrets.paths(secret)
+	if secret.Type != corev1.SecretTypeTLS {
+		fmt.Printf("Ignoring secret %s, it is of type %s, not %s\n", key, secret.Type, corev1.SecretTypeTLS)
+		events <- TLSSecretEvent{Type: watch.Deleted, Secret: key, CertPath: certPath}
+		return
+	}
+	if t.listOnly {
+		events <- TLSSecretEvent{Type: watch.Modified, Secret: key, CertPath: certPath, KeyPath: keyPath}
+		return
+	}
+	changed, err := t.writeSecret(secret, certPath, keyPath)
+	if err != nil {
+		fmt.Printf("Writing secret %s to %s and %s failed: %v\n", key, certPath, keyPath, err)
+		return
+	}
+	if changed {
+		fmt.Printf("Wrote secret %s to %s and %s\n", key, certPath, keyPath)
+	}
+	events <- TLSSecretEvent{Type: watch.Modified, Secret: key, CertPath: certPath, KeyPath: keyPath, Changed: changed}
+}
+
+func (t *TLSSecretWatcher) Run(ctx context.Context, events chan<- TLSSecretEvent, stop <-chan struct{}) error {
+	options := metav1.ListOptions{LabelSelector: t.secrets.labelSelector}
+	if t.secrets.name != "" {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", t.secrets.name).String()
+	}
+	watchEvents := make(chan watch.Event)
+	watchEnded := make(chan error, 1)
+	var initialList []corev1.Secret
+	listed := false
+	for _, api := range t.kubernetesAPIs {
+		fmt.Printf("Getting initial list of secrets: --namespace=%s --selector=%s --field-selector=%s\n", t.secrets.namespace, options.LabelSelector, options.FieldSelector)
+		if !listed {
+			secrets, err := api.CoreV1().Secrets(t.secrets.namespace).List(ctx, options)
+			if err != nil {
+				fmt.Printf("Listing secrets failed: %v\n", err)
+				continue // Maybe another call will succeed?
+			}
+			initialList = secrets.Items
+			listed = true
+		}
+		if t.listOnly {
+			break
+		}
+		watcher, err := api.CoreV1().Secrets(t.secrets.namespace).Watch(ctx, options)
+		if err != nil {
+			return err
+		}
+		defer watcher.Stop()
+		go forwardWatch("secrets", watcher, sendWatchEvent(watchEvents, stop), watchEnded)
+	}
+
+	if !listed {
+		return fmt.Errorf("Did not get an initial list of secrets")
+	}
+
+	for _, secret := range initialList {
+		t.processSecret(&secret, events)
+	}
+	notifySynced(t.synced)
+	if t.listOnly {
+		return nil
+	}
+
+	running := true
+
+	for running {
+		select {
+		case watchEvent := <-watchEvents:
+			secret, ok := watchEvent.Object.(*corev1.Secret)
+			if !ok {
+				// TODO: Pass error
+				fmt.Printf("Unexpected watch event for secrets: %#v\n", watchEvent)
+				continue
+			}
+			switch watchEvent.Type {
+			case watch.Added, watch.Modified:
+				t.processSecret(secret, events)
+			case watch.Deleted:
+				// The files are left in place, as the load balancer may still be using them until it is reconfigured
+				certPath, _ := t.secrets.paths(secret)
+				events <- TLSSecretEvent{Type: watch.Deleted, Secret: fmt.Sprintf("%s/%s", secret.Namespace, secret.Name), CertPath: certPath}
+			}
+		case err := <-watchEnded:
+			return err
+		case <-stop:
+			running = false
+		}
+	}
+	return nil
+}
+
+// TLSSecretVars are the template variables for a TLS secret which has been written to disk
+type TLSSecretVars struct {
+	// Secret is the namespace/name of the secret
+	Secret   string `json:"secret"`
+	CertPath string `json:"certPath"`
+	KeyPath  string `json:"keyPath"`
+}
+
+// tlsSecretVars returns the template variables for all TLS secrets written to disk, sorted by secret, then path
+func (c *clusterState) tlsSecretVars() []TLSSecretVars {
+	secrets := make([]TLSSecretVars, 0, len(c.tlsSecrets))
+	for _, secret := range c.tlsSecrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		if secrets[i].Secret != secrets[j].Secret {
+			return secrets[i].Secret < secrets[j].Secret
+		}
+		return secrets[i].CertPath < secrets[j].CertPath
+	})
+	return secrets
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestTLSSecretDescriptionFromConfig(t *testing.T) {
+	labels := &metav1.LabelSelector{MatchLabels: map[string]string{"doorman": "true"}}
+	cases := []struct {
+		name    string
+		cfg     public.TLSSecretConfigFile
+		wantErr bool
+	}{
+		{name: "name", cfg: public.TLSSecretConfigFile{Namespace: "default", Name: "tls", CertPath: "/tmp/tls.crt", KeyPath: "/tmp/tls.key"}},
+		{name: "labels", cfg: public.TLSSecretConfigFile{Labels: labels, Directory: "/tmp/tls"}},
+		{name: "neither name nor labels", cfg: public.TLSSecretConfigFile{Directory: "/tmp/tls"}, wantErr: true},
+		{name: "name and labels", cfg: public.TLSSecretConfigFile{Namespace: "default", Name: "tls", CertPath: "/tmp/tls.crt", KeyPath: "/tmp/tls.key", Labels: labels, Directory: "/tmp/tls"}, wantErr: true},
+		{name: "name without a namespace", cfg: public.TLSSecretConfigFile{Name: "tls", CertPath: "/tmp/tls.crt", KeyPath: "/tmp/tls.key"}, wantErr: true},
+		{name: "name without paths", cfg: public.TLSSecretConfigFile{Namespace: "default", Name: "tls"}, wantErr: true},
+		{name: "same paths", cfg: public.TLSSecretConfigFile{Namespace: "default", Name: "tls", CertPath: "/tmp/tls", KeyPath: "/tmp/tls"}, wantErr: true},
+		{name: "labels without a directory", cfg: public.TLSSecretConfigFile{Labels: labels}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var d TLSSecretDescription
+			err := d.FromConfig(&c.cfg)
+			if c.wantErr && err == nil {
+				t.Error("Expected an error")
+			}
+			if !c.wantErr && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTLSSecretDescriptionPaths(t *testing.T) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "a-tls"}}
+	named := TLSSecretDescription{name: "a-tls", certPath: "/etc/tls/a.crt", keyPath: "/etc/tls/a.key"}
+	if cert, key := named.paths(secret); cert != "/etc/tls/a.crt" || key != "/etc/tls/a.key" {
+		t.Errorf("Got %s and %s for a named secret", cert, key)
+	}
+	labeled := TLSSecretDescription{directory: "/etc/tls"}
+	if cert, key := labeled.paths(secret); cert != "/etc/tls/web/a-tls.crt" || key != "/etc/tls/web/a-tls.key" {
+		t.Errorf("Got %s and %s for a labeled secret", cert, key)
+	}
+}
+
+func TestTLSSecretWatcherWriteSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doorman-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "default", "tls.crt")
+	keyPath := filepath.Join(dir, "default", "tls.key")
+	secret := func(cert, key string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls"},
+			Type:       corev1.SecretTypeTLS,
+			Data:       map[string][]byte{corev1.TLSCertKey: []byte(cert), corev1.TLSPrivateKeyKey: []byte(key)},
+		}
+	}
+	expectFiles := func(cert, key string) {
+		t.Helper()
+		for path, want := range map[string]string{certPath: cert, keyPath: key} {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != want {
+				t.Errorf("Got %q in %s, want %q", data, path, want)
+			}
+		}
+		entries, err := ioutil.ReadDir(filepath.Dir(certPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("Got %d files, want only the certificate and key", len(entries))
+		}
+	}
+	var w TLSSecretWatcher
+
+	changed, err := w.writeSecret(secret("cert1", "key1"), certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("New files were not reported as changed")
+	}
+	expectFiles("cert1", "key1")
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key has mode %v, want 0600", info.Mode().Perm())
+	}
+
+	changed, err = w.writeSecret(secret("cert1", "key1"), certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("Unchanged files were reported as changed")
+	}
+
+	changed, err = w.writeSecret(secret("cert2", "key2"), certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("Rotated files were not reported as changed")
+	}
+	expectFiles("cert2", "key2")
+
+	// A secret which cannot be written leaves the previous pair in place
+	if _, err := w.writeSecret(&corev1.Secret{Data: map[string][]byte{corev1.TLSCertKey: []byte("cert3")}}, certPath, keyPath); err == nil {
+		t.Error("Expected an error for a secret without a key")
+	}
+	if err := os.Mkdir(filepath.Join(dir, "cert"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.writeSecret(secret("cert3", "key3"), filepath.Join(dir, "cert"), keyPath); err == nil {
+		t.Error("Expected an error for a certificate path which is a directory")
+	}
+	expectFiles("cert2", "key2")
+}
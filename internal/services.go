@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"strconv"
+	"strings"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+type NodePortServicesDescription struct {
+	namespace     string
+	labelSelector string
+	listenAddress string
+	options       PortOptions
+}
+
+func (n *NodePortServicesDescription) FromConfig(cfg *public.NodePortServicesConfigFile) error {
+	n.namespace = cfg.Namespace
+	if cfg.Labels != nil {
+		selector, err := metav1.LabelSelectorAsSelector(cfg.Labels)
+		if err != nil {
+			return err
+		}
+		n.labelSelector = selector.String()
+	}
+	n.listenAddress = cfg.ListenAddress
+	n.options.FromConfig(cfg.PortOptions)
+	return nil
+}
+
+// parseListenPorts parses the value of the listen ports annotation into a map from service port names or numbers to listen ports
+func parseListenPorts(annotation string) (map[string]int, error) {
+	listenPorts := make(map[string]int)
+	for _, entry := range strings.Split(annotation, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected name=port, got %q", entry)
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port in %q: %v", entry, err)
+		}
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Port in %q is outside of 1-65535", entry)
+		}
+		listenPorts[strings.TrimSpace(parts[0])] = port
+	}
+	return listenPorts, nil
+}
+
+// PortsFromService returns a mapping to each NodePort of a service from the port to listen on for it
+func (n *NodePortServicesDescription) PortsFromService(svc *corev1.Service) ([]PortMapping, error) {
+	var listenPorts map[string]int
+	if annotation, ok := svc.Annotations[public.ListenPortsAnnotation]; ok {
+		var err error
+		listenPorts, err = parseListenPorts(annotation)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s annotation: %v", public.ListenPortsAnnotation, err)
+		}
+	}
+	localService := ""
+	if svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+		localService = serviceKey(svc)
+	}
+	ports := make([]PortMapping, 0, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		if port.NodePort == 0 {
+			continue
+		}
+		if port.Protocol != corev1.ProtocolTCP && port.Protocol != corev1.ProtocolUDP {
+			continue
+		}
+		source := int(port.Port)
+		if listenPort, ok := listenPorts[port.Name]; ok && port.Name != "" {
+			source = listenPort
+		} else if listenPort, ok := listenPorts[strconv.Itoa(int(port.Port))]; ok {
+			source = listenPort
+		}
+		ports = append(ports, PortMapping{
+			Source:       source,
+			Dest:         int(port.NodePort),
+			Address:      n.listenAddress,
+			Protocol:     port.Protocol,
+			Range:        public.PortRange{First: source, Last: source},
+			LocalService: localService,
+			PortOptions:  n.options,
+		})
+	}
+	return ports, nil
+}
+
+// ServiceWatcher discovers the NodePorts of Services for a pool
+type ServiceWatcher struct {
+	kubernetesAPIs []kubernetes.Interface
+	pool           string
+	services       NodePortServicesDescription
+	// claims, if not nil, are where the listeners of discovered ports are recorded for the load balancer controller
+	claims *listenerClaims
+	// synced, if not nil, is called once the initial list has been sent
+	synced func()
+	// listOnly, if set, stops the watcher once the initial list has been sent, instead of watching for changes
+	listOnly bool
+}
+
+func (s *ServiceWatcher) processService(svc *corev1.Service, events chan<- ServicePortsEvent) {
+	key := serviceKey(svc)
+	ports, err := s.services.PortsFromService(svc)
+	if err != nil {
+		fmt.Printf("Ignoring service %s for pool %s: %v\n", key, s.pool, err)
+	}
+	fmt.Printf("Service ports for pool %s: %s, %v\n", s.pool, key, ports)
+	if s.claims != nil {
+		s.claims.set(s.pool, key, ports)
+	}
+	events <- ServicePortsEvent{Pool: s.pool, Service: key, Ports: ports}
+}
+
+// watchServices gets the initial list of services from the first API that succeeds, and starts watches on all APIs which send to watchEvents until stop is closed.
+// If a watch ends by itself, an error is sent to watchEnded. The returned function stops the watches. If listOnly is set, no watches are started.
+func watchServices(ctx context.Context, kubernetesAPIs []kubernetes.Interface, namespace, labelSelector string, listOnly bool, watchEvents chan<- watch.Event, watchEnded chan<- error, stop <-chan struct{}) ([]corev1.Service, func(), error) {
+	options := metav1.ListOptions{LabelSelector: labelSelector}
+	var initialList []corev1.Service
+	listed := false
+	watchers := make([]watch.Interface, 0, len(kubernetesAPIs))
+	stopWatches := func() {
+		for _, watcher := range watchers {
+			watcher.Stop()
+		}
+	}
+	for _, api := range kubernetesAPIs {
+		fmt.Printf("Getting initial list of services: --namespace=%s --selector=%s\n", namespace, labelSelector)
+		if !listed {
+			services, err := api.CoreV1().Services(namespace).List(ctx, options)
+			if err != nil {
+				fmt.Printf("Listing services failed: %v\n", err)
+				continue // Maybe another call will succeed?
+			}
+			initialList = services.Items
+			listed = true
+		}
+		if listOnly {
+			break
+		}
+		watcher, err := api.CoreV1().Services(namespace).Watch(ctx, options)
+		if err != nil {
+			stopWatches()
+			return nil, nil, err
+		}
+		watchers = append(watchers, watcher)
+		go forwardWatch("services", watcher, sendWatchEvent(watchEvents, stop), watchEnded)
+	}
+
+	if !listed {
+		stopWatches()
+		return nil, nil, fmt.Errorf("Did not get an initial list of services")
+	}
+	return initialList, stopWatches, nil
+}
+
+func (s *ServiceWatcher) Run(ctx context.Context, events chan<- ServicePortsEvent, stop <-chan struct{}) error {
+	watchEvents := make(chan watch.Event)
+	watchEnded := make(chan error, 1)
+	initialList, stopWatches, err := watchServices(ctx, s.kubernetesAPIs, s.services.namespace, s.services.labelSelector, s.listOnly, watchEvents, watchEnded, stop)
+	if err != nil {
+		return err
+	}
+	defer stopWatches()
+
+	for _, svc := range initialList {
+		s.processService(&svc, events)
+	}
+	notifySynced(s.synced)
+	if s.listOnly {
+		return nil
+	}
+
+	running := true
+
+	for running {
+		select {
+		case watchEvent := <-watchEvents:
+			svc, ok := watchEvent.Object.(*corev1.Service)
+			if !ok {
+				// TODO: Pass error
+				fmt.Printf("Unexpected watch event for pool %s: %#v\n", s.pool, watchEvent)
+				continue
+			}
+			switch watchEvent.Type {
+			case watch.Added, watch.Modified:
+				s.processService(svc, events)
+			case watch.Deleted:
+				if s.claims != nil {
+					s.claims.set(s.pool, serviceKey(svc), nil)
+				}
+				events <- ServicePortsEvent{Pool: s.pool, Service: serviceKey(svc)}
+			}
+		case err := <-watchEnded:
+			return err
+		case <-stop:
+			running = false
+		}
+	}
+	return nil
+}
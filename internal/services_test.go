@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestParseListenPorts(t *testing.T) {
+	cases := []struct {
+		annotation string
+		want       map[string]int
+		wantErr    bool
+	}{
+		{annotation: "", want: map[string]int{}},
+		{annotation: "http=80", want: map[string]int{"http": 80}},
+		{annotation: " http = 80 , 8443=443, ", want: map[string]int{"http": 80, "8443": 443}},
+		{annotation: "http", wantErr: true},
+		{annotation: "http=web", wantErr: true},
+		{annotation: "http=0", wantErr: true},
+		{annotation: "http=65536", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.annotation, func(t *testing.T) {
+			got, err := parseListenPorts(c.annotation)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestNodePortServicesPortsFromService(t *testing.T) {
+	service := func(annotations map[string]string, ports ...corev1.ServicePort) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Annotations: annotations},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort, Ports: ports},
+		}
+	}
+	mapping := func(address string, protocol corev1.Protocol, source, dest int) PortMapping {
+		return PortMapping{Source: source, Dest: dest, Address: address, Protocol: protocol, Range: public.PortRange{First: source, Last: source}}
+	}
+	cases := []struct {
+		name     string
+		services NodePortServicesDescription
+		svc      *corev1.Service
+		want     []PortMapping
+		wantErr  bool
+	}{
+		{
+			name: "node ports",
+			svc: service(nil,
+				corev1.ServicePort{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080},
+				corev1.ServicePort{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 53, NodePort: 30053},
+			),
+			want: []PortMapping{mapping("", corev1.ProtocolTCP, 80, 30080), mapping("", corev1.ProtocolUDP, 53, 30053)},
+		},
+		{
+			name: "ports without a node port or of other protocols are skipped",
+			svc: service(nil,
+				corev1.ServicePort{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+				corev1.ServicePort{Name: "sctp", Protocol: corev1.ProtocolSCTP, Port: 9000, NodePort: 30900},
+			),
+			want: []PortMapping{},
+		},
+		{
+			name: "listen ports by name and number",
+			svc: service(map[string]string{public.ListenPortsAnnotation: "http=8080,443=8443"},
+				corev1.ServicePort{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080},
+				corev1.ServicePort{Name: "https", Protocol: corev1.ProtocolTCP, Port: 443, NodePort: 30443},
+			),
+			want: []PortMapping{mapping("", corev1.ProtocolTCP, 8080, 30080), mapping("", corev1.ProtocolTCP, 8443, 30443)},
+		},
+		{
+			name:     "listen address and options",
+			services: NodePortServicesDescription{listenAddress: "10.0.0.10", options: PortOptions{Algorithm: "random"}},
+			svc:      service(nil, corev1.ServicePort{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}),
+			want: []PortMapping{
+				{Source: 80, Dest: 30080, Address: "10.0.0.10", Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 80, Last: 80}, PortOptions: PortOptions{Algorithm: "random"}},
+			},
+		},
+		{
+			name: "local traffic policy",
+			svc: func() *corev1.Service {
+				svc := service(nil, corev1.ServicePort{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080})
+				svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyTypeLocal
+				return svc
+			}(),
+			want: []PortMapping{
+				{Source: 80, Dest: 30080, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 80, Last: 80}, LocalService: "default/web"},
+			},
+		},
+		{
+			name:    "invalid annotation",
+			svc:     service(map[string]string{public.ListenPortsAnnotation: "http=none"}, corev1.ServicePort{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}),
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.services.PortsFromService(c.svc)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestServiceWatcher(t *testing.T) {
+	nodePortService := func(name string, port, nodePort int32) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec: corev1.ServiceSpec{
+				Type:  corev1.ServiceTypeNodePort,
+				Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: port, NodePort: nodePort}},
+			},
+		}
+	}
+	client := fake.NewSimpleClientset(nodePortService("web", 80, 30080))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	claims := newListenerClaims()
+	synced := make(chan struct{})
+	watcher := ServiceWatcher{
+		kubernetesAPIs: []kubernetes.Interface{client},
+		pool:           "workers",
+		claims:         claims,
+		synced:         func() { close(synced) },
+	}
+	events := make(chan ServicePortsEvent, 10)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(ctx, events, stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	expect := func(service string, ports []PortMapping) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Pool != "workers" || event.Service != service || !reflect.DeepEqual(event.Ports, ports) {
+				t.Fatalf("Got event %+v, want ports %v of service %s", event, ports, service)
+			}
+		case err := <-done:
+			t.Fatalf("Watcher stopped: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for ports of service %s", service)
+		}
+	}
+	expect("default/web", []PortMapping{{Source: 80, Dest: 30080, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 80, Last: 80}}})
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the watcher to sync")
+	}
+	listener := Listener{Protocol: corev1.ProtocolTCP, Port: 80}
+	if owner, ok := claims.owner(listener); !ok || owner != "default/web in pool workers" {
+		t.Errorf("Listener %s is claimed by %q, want default/web in pool workers", listener, owner)
+	}
+
+	if _, err := client.CoreV1().Services("default").Create(ctx, nodePortService("api", 8080, 30081), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect("default/api", []PortMapping{{Source: 8080, Dest: 30081, Protocol: corev1.ProtocolTCP, Range: public.PortRange{First: 8080, Last: 8080}}})
+
+	if err := client.CoreV1().Services("default").Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expect("default/web", nil)
+	if _, ok := claims.owner(listener); ok {
+		t.Errorf("Listener %s is still claimed after its service was deleted", listener)
+	}
+}
+
+func TestServiceWatcherListOnly(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeNodePort,
+			Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	})
+	synced := false
+	watcher := ServiceWatcher{
+		kubernetesAPIs: []kubernetes.Interface{client},
+		pool:           "workers",
+		synced:         func() { synced = true },
+		listOnly:       true,
+	}
+	events := make(chan ServicePortsEvent, 10)
+	done := make(chan error, 1)
+	go func() { done <- watcher.Run(context.Background(), events, make(chan struct{})) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the watcher to stop after listing")
+	}
+	if !synced {
+		t.Error("Watcher stopped without syncing")
+	}
+	if len(events) != 1 {
+		t.Fatalf("Got %d events, want 1", len(events))
+	}
+	if event := <-events; event.Service != "default/web" || len(event.Ports) != 1 {
+		t.Errorf("Got event %+v, want the ports of default/web", event)
+	}
+}
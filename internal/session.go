@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// notifySynced calls a watcher's synced function, if it has one
+func notifySynced(synced func()) {
+	if synced != nil {
+		synced()
+	}
+}
+
+// forwardWatch sends each event of a watch with send, until send returns false because the watcher was stopped.
+// If the watch ends first, e.g. because the API server timed it out, an error is sent to ended, so that the watcher fails
+// and the session is restarted, instead of its events silently stopping.
+func forwardWatch(what string, watcher watch.Interface, send func(watch.Event) bool, ended chan<- error) {
+	for event := range watcher.ResultChan() {
+		if !send(event) {
+			return
+		}
+	}
+	select {
+	case ended <- fmt.Errorf("Watch of %s ended", what):
+	default:
+	}
+}
+
+// sendWatchEvent returns a function for forwardWatch which sends events to watchEvents until stop is closed
+func sendWatchEvent(watchEvents chan<- watch.Event, stop <-chan struct{}) func(watch.Event) bool {
+	return func(event watch.Event) bool {
+		select {
+		case watchEvents <- event:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// watchSession is a set of watchers, started together, and the state built from their events.
+// If any watcher fails, the whole session is stopped and a new one is started, so that the state is rebuilt from scratch
+// instead of missing anything which changed while the watcher was not running.
+type watchSession struct {
+	state               *clusterState
+	events              chan NodeEvent
+	serviceEvents       chan ServicePortsEvent
+	endpointSliceEvents chan EndpointSliceEvent
+	ingressEvents       chan IngressEvent
+	tlsSecretEvents     chan TLSSecretEvent
+	// synced receives the name of each watcher once it has sent its initial list
+	synced chan string
+	// errs receives the error of each watcher which fails
+	errs chan error
+	stop chan struct{}
+	wg   sync.WaitGroup
+	// pending are the names of the watchers which have not yet sent their initial list
+	pending map[string]struct{}
+}
+
+// isSynced returns true if every watcher has sent its initial list
+func (s *watchSession) isSynced() bool {
+	return len(s.pending) == 0
+}
+
+// pendingWatchers returns the names of the watchers which have not yet sent their initial list, sorted
+func (s *watchSession) pendingWatchers() string {
+	pending := make([]string, 0, len(s.pending))
+	for name := range s.pending {
+		pending = append(pending, name)
+	}
+	sort.Strings(pending)
+	return strings.Join(pending, ", ")
+}
+
+// start runs a watcher in the background, and reports when it has synced or if it fails
+func (s *watchSession) start(name string, run func(synced func(), stop <-chan struct{}) error) {
+	fmt.Printf("Starting %s\n", name)
+	s.pending[name] = struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		synced := func() {
+			select {
+			case s.synced <- name:
+			case <-s.stop:
+			}
+		}
+		err := run(synced, s.stop)
+		if err == nil {
+			return
+		}
+		select {
+		case s.errs <- fmt.Errorf("%s failed: %v", name, err):
+		case <-s.stop:
+		}
+	}()
+}
+
+// close stops all watchers, and discards anything they send until they have stopped
+func (s *watchSession) close() {
+	if s.stop == nil {
+		// Nothing was started
+		return
+	}
+	close(s.stop)
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	go func() {
+		for {
+			select {
+			case <-s.events:
+			case <-s.serviceEvents:
+			case <-s.endpointSliceEvents:
+			case <-s.ingressEvents:
+			case <-s.tlsSecretEvents:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// startWatches starts a new session with all of the watchers required by the config.
+// If listOnly is set, the session is a relist for a resync: each watcher stops once it has sent its initial list, and the load balancer
+// controller is not started, as its ports are assigned by doorman rather than listed from the cluster.
+func (d *Doorman) startWatches(ctx context.Context, listOnly bool) *watchSession {
+	s := &watchSession{
+		state:               newClusterState(),
+		events:              make(chan NodeEvent),
+		serviceEvents:       make(chan ServicePortsEvent),
+		endpointSliceEvents: make(chan EndpointSliceEvent),
+		ingressEvents:       make(chan IngressEvent),
+		tlsSecretEvents:     make(chan TLSSecretEvent),
+		synced:              make(chan string),
+		errs:                make(chan error),
+		stop:                make(chan struct{}),
+		pending:             make(map[string]struct{}),
+	}
+	// Ports discovered for node pools take precedence over those assigned by the load balancer controller, which must not assign them
+	var claims *listenerClaims
+	if d.loadBalancer != nil && !listOnly {
+		claims = newListenerClaims()
+	}
+	for _, pool := range d.nodePools {
+		pool := pool
+		s.state.pools[pool.name] = newPoolState(pool.preferredZone)
+		s.start(fmt.Sprintf("watcher for pool %s", pool.name), func(synced func(), stop <-chan struct{}) error {
+			return (&PoolWatcher{
+				kubernetesAPIs: d.kubernetesAPIs,
+				pool:           pool,
+				synced:         synced,
+				listOnly:       listOnly,
+			}).Run(ctx, s.events, stop)
+		})
+		if pool.nodePortServices != nil {
+			s.start(fmt.Sprintf("service watcher for pool %s", pool.name), func(synced func(), stop <-chan struct{}) error {
+				return (&ServiceWatcher{
+					kubernetesAPIs: d.kubernetesAPIs,
+					pool:           pool.name,
+					services:       *pool.nodePortServices,
+					claims:         claims,
+					synced:         synced,
+					listOnly:       listOnly,
+				}).Run(ctx, s.serviceEvents, stop)
+			})
+		}
+	}
+	for _, pool := range d.endpointPools {
+		pool := pool
+		s.state.pools[pool.name] = newPoolState(pool.preferredZone)
+		s.start(fmt.Sprintf("endpoint watcher for pool %s", pool.name), func(synced func(), stop <-chan struct{}) error {
+			return (&EndpointPoolWatcher{
+				kubernetesAPIs: d.kubernetesAPIs,
+				pool:           pool,
+				synced:         synced,
+				listOnly:       listOnly,
+			}).Run(ctx, s.events, s.serviceEvents, stop)
+		})
+	}
+	if d.loadBalancer != nil && !listOnly {
+		reserved := make(map[Listener]struct{})
+		for _, pool := range d.nodePools {
+			for _, port := range pool.ports {
+				reserved[port.Listener().normalized()] = struct{}{}
+			}
+		}
+		for _, pool := range d.endpointPools {
+			for _, port := range pool.ports {
+				reserved[port.Listener().normalized()] = struct{}{}
+			}
+		}
+		s.start("load balancer controller", func(synced func(), stop <-chan struct{}) error {
+			return (&LoadBalancerController{
+				kubernetesAPIs: d.kubernetesAPIs,
+				loadBalancer:   *d.loadBalancer,
+				reserved:       reserved,
+				claims:         claims,
+				synced:         synced,
+			}).Run(ctx, s.serviceEvents, stop)
+		})
+	}
+	for _, namespace := range d.endpointSliceNamespaces() {
+		namespace := namespace
+		s.start(fmt.Sprintf("endpoint slice watcher for namespace %q", namespace), func(synced func(), stop <-chan struct{}) error {
+			return (&EndpointSliceWatcher{
+				kubernetesAPIs: d.kubernetesAPIs,
+				namespace:      namespace,
+				synced:         synced,
+				listOnly:       listOnly,
+			}).Run(ctx, s.endpointSliceEvents, stop)
+		})
+	}
+	if d.ingresses != nil {
+		s.start("ingress watcher", func(synced func(), stop <-chan struct{}) error {
+			return (&IngressWatcher{
+				kubernetesAPIs: d.kubernetesAPIs,
+				ingresses:      *d.ingresses,
+				synced:         synced,
+				listOnly:       listOnly,
+			}).Run(ctx, s.ingressEvents, stop)
+		})
+	}
+	for i, secrets := range d.tlsSecrets {
+		secrets := secrets
+		s.start(fmt.Sprintf("TLS secret watcher %d", i), func(synced func(), stop <-chan struct{}) error {
+			return (&TLSSecretWatcher{
+				kubernetesAPIs: d.kubernetesAPIs,
+				secrets:        secrets,
+				synced:         synced,
+				listOnly:       listOnly,
+			}).Run(ctx, s.tlsSecretEvents, stop)
+		})
+	}
+	return s
+}
+
+// restartingSession is a placeholder while waiting to start a new session after one failed. It has no watchers, and never syncs.
+func restartingSession() *watchSession {
+	return &watchSession{state: newClusterState(), pending: map[string]struct{}{"(waiting to restart)": {}}}
+}
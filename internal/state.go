@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/watch"
+	"sort"
+)
+
+// nodeState is the addresses and zone of a member of a pool
+type nodeState struct {
+	addresses []string
+	zone      string
+}
+
+// poolState is the current membership and discovered ports of a node pool
+type poolState struct {
+	// nodes maps the name of each node in the pool to its state
+	nodes map[string]nodeState
+	// servicePorts maps the namespace/name of each service to the ports discovered from it
+	servicePorts map[string][]PortMapping
+	// preferredZone is the zone whose nodes are preferred, if any
+	preferredZone string
+}
+
+func newPoolState(preferredZone string) *poolState {
+	return &poolState{nodes: make(map[string]nodeState), servicePorts: make(map[string][]PortMapping), preferredZone: preferredZone}
+}
+
+// addresses returns the addresses of the nodes in the pool, mapped to the zone of their node. If onlyNodes is not nil, only nodes in it are included.
+func (p *poolState) addresses(onlyNodes map[string]struct{}) map[string]string {
+	addresses := make(map[string]string)
+	for node, state := range p.nodes {
+		if onlyNodes != nil {
+			if _, ok := onlyNodes[node]; !ok {
+				continue
+			}
+		}
+		for _, address := range state.addresses {
+			addresses[address] = state.zone
+		}
+	}
+	return addresses
+}
+
+// endpointSliceState is the service an EndpointSlice belongs to, and the nodes its ready endpoints are on
+type endpointSliceState struct {
+	service string
+	nodes   []string
+}
+
+// ingressState is the pool an Ingress is routed to, and its rules
+type ingressState struct {
+	pool  string
+	rules []IngressRule
+}
+
+// clusterState is everything known about the cluster which is used to produce template variables
+type clusterState struct {
+	pools map[string]*poolState
+	// endpointSlices maps the namespace/name of each EndpointSlice to its state
+	endpointSlices map[string]endpointSliceState
+	// ingresses maps the namespace/name of each Ingress to its state
+	ingresses map[string]ingressState
+	// tlsSecrets maps the certificate path of each TLS secret written to disk to its template variables
+	tlsSecrets map[string]TLSSecretVars
+}
+
+func newClusterState() *clusterState {
+	return &clusterState{pools: make(map[string]*poolState), endpointSlices: make(map[string]endpointSliceState), ingresses: make(map[string]ingressState), tlsSecrets: make(map[string]TLSSecretVars)}
+}
+
+// applyNodeEvent updates the members of a pool
+func (c *clusterState) applyNodeEvent(event NodeEvent) {
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		c.pools[event.Pool].nodes[event.Node] = nodeState{addresses: event.Addresses, zone: event.Zone}
+	case watch.Deleted:
+		delete(c.pools[event.Pool].nodes, event.Node)
+		// TODO: Handle remaining events
+		// Error: ???
+	}
+}
+
+// applyServicePortsEvent updates the ports discovered from a service for a pool
+func (c *clusterState) applyServicePortsEvent(event ServicePortsEvent) {
+	if len(event.Ports) == 0 {
+		delete(c.pools[event.Pool].servicePorts, event.Service)
+	} else {
+		c.pools[event.Pool].servicePorts[event.Service] = event.Ports
+	}
+}
+
+// applyEndpointSliceEvent updates the nodes with ready endpoints of an EndpointSlice
+func (c *clusterState) applyEndpointSliceEvent(event EndpointSliceEvent) {
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		c.endpointSlices[event.Slice] = endpointSliceState{service: event.Service, nodes: event.Nodes}
+	case watch.Deleted:
+		delete(c.endpointSlices, event.Slice)
+	}
+}
+
+// applyIngressEvent updates the rules of an Ingress
+func (c *clusterState) applyIngressEvent(event IngressEvent) {
+	if len(event.Rules) == 0 {
+		delete(c.ingresses, event.Ingress)
+	} else {
+		c.ingresses[event.Ingress] = ingressState{pool: event.Pool, rules: event.Rules}
+	}
+}
+
+// applyTLSSecretEvent updates the TLS secrets written to disk
+func (c *clusterState) applyTLSSecretEvent(event TLSSecretEvent) {
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		c.tlsSecrets[event.CertPath] = TLSSecretVars{Secret: event.Secret, CertPath: event.CertPath, KeyPath: event.KeyPath}
+	case watch.Deleted:
+		delete(c.tlsSecrets, event.CertPath)
+	}
+}
+
+// copyLoadBalancerPorts replaces the ports assigned by the load balancer controller with those of another state
+func (c *clusterState) copyLoadBalancerPorts(from *clusterState) {
+	for name, pool := range c.pools {
+		for service := range pool.servicePorts {
+			if isLoadBalancerPorts(service) {
+				delete(pool.servicePorts, service)
+			}
+		}
+		fromPool, ok := from.pools[name]
+		if !ok {
+			continue
+		}
+		for service, ports := range fromPool.servicePorts {
+			if isLoadBalancerPorts(service) {
+				pool.servicePorts[service] = ports
+			}
+		}
+	}
+}
+
+// localNodes returns the names of the nodes with a ready endpoint for a service
+func (c *clusterState) localNodes(service string) map[string]struct{} {
+	nodes := make(map[string]struct{})
+	for _, slice := range c.endpointSlices {
+		if slice.service != service {
+			continue
+		}
+		for _, node := range slice.nodes {
+			nodes[node] = struct{}{}
+		}
+	}
+	return nodes
+}
+
+// portAddresses returns the addresses to use for a port of a pool, which are only those of nodes with a ready endpoint if the port is linked to a service
+func (c *clusterState) portAddresses(pool string, port PortMapping) map[string]string {
+	if port.LocalService == "" {
+		return c.pools[pool].addresses(nil)
+	}
+	return c.pools[pool].addresses(c.localNodes(port.LocalService))
+}
+
+// withFallback returns the addresses to use for a port of a pool, or for the pool's HTTP hosts if port is nil,
+// or those of its first fallback pool which has any if the pool has none.
+// A port linked to a service only uses the nodes of a fallback pool with a ready endpoint, the same as for the pool itself, as the others drop its traffic.
+// If the pool's fallbacks are used as backups, the addresses of all of them are also returned as backup addresses.
+func (d *Doorman) withFallback(state *clusterState, pool string, port *PortMapping) (map[string]string, map[string]string) {
+	poolAddresses := func(pool string) map[string]string {
+		if port == nil {
+			return state.pools[pool].addresses(nil)
+		}
+		return state.portAddresses(pool, *port)
+	}
+	addresses := poolAddresses(pool)
+	description := d.nodePool(pool)
+	if description == nil || len(description.fallbackPools) == 0 {
+		return addresses, nil
+	}
+	if len(addresses) == 0 {
+		for _, fallback := range description.fallbackPools {
+			fallbackAddresses := poolAddresses(fallback)
+			if len(fallbackAddresses) != 0 {
+				d.logFallback(pool, port, fallback)
+				return fallbackAddresses, nil
+			}
+		}
+		d.logFallback(pool, port, "")
+		return addresses, nil
+	}
+	d.logFallback(pool, port, "")
+	if !description.fallbackAsBackup {
+		return addresses, nil
+	}
+	backupAddresses := make(map[string]string)
+	for _, fallback := range description.fallbackPools {
+		for address, zone := range poolAddresses(fallback) {
+			backupAddresses[address] = zone
+		}
+	}
+	return addresses, backupAddresses
+}
+
+// logFallback logs when a port of a pool, or its HTTP hosts if port is nil, starts or stops using a fallback pool, which is empty if it does not use one
+func (d *Doorman) logFallback(pool string, port *PortMapping, fallback string) {
+	user := fmt.Sprintf("HTTP hosts of pool %s", pool)
+	if port != nil {
+		user = fmt.Sprintf("Listener %s of pool %s", port.Listener(), pool)
+	}
+	if d.fallbacks == nil {
+		d.fallbacks = make(map[string]string)
+	}
+	previous := d.fallbacks[user]
+	if previous == fallback {
+		return
+	}
+	if fallback == "" {
+		fmt.Printf("%s has nodes again, no longer using fallback pool %s\n", user, previous)
+		delete(d.fallbacks, user)
+		return
+	}
+	fmt.Printf("%s has no nodes, using fallback pool %s\n", user, fallback)
+	d.fallbacks[user] = fallback
+}
+
+// listeners computes the set of addresses for each listener from the current state of all pools.
+// Ports from the config file take precedence over discovered ports, and discovered ports which conflict with
+// ports already in use are ignored.
+func (d *Doorman) listeners(state *clusterState) portPools {
+	pools := make(portPools)
+	used := make(map[Listener]string)
+	for _, pool := range d.nodePools {
+		for _, port := range pool.ports {
+			addresses, backupAddresses := d.withFallback(state, pool.name, &port)
+			pools.init(pool.name, port, addresses, backupAddresses, pool.preferredZone)
+			used[port.Listener().normalized()] = pool.name
+		}
+	}
+	// Endpoint pools' ports are known up front, so they go before ports discovered for node pools
+	names := make([]string, 0, len(d.endpointPools)+len(d.nodePools))
+	for _, pool := range d.endpointPools {
+		names = append(names, pool.name)
+	}
+	for _, pool := range d.nodePools {
+		names = append(names, pool.name)
+	}
+	// Ports assigned by the load balancer controller go last, as it does not assign ports which were discovered, but may not have seen them yet
+	for _, loadBalancer := range []bool{false, true} {
+		for _, name := range names {
+			d.serviceListeners(state, pools, used, name, loadBalancer)
+		}
+	}
+	return pools
+}
+
+// serviceListeners adds the ports discovered for a pool to its listeners, either those assigned by the load balancer controller or all others
+func (d *Doorman) serviceListeners(state *clusterState, pools portPools, used map[Listener]string, name string, loadBalancer bool) {
+	poolState := state.pools[name]
+	services := make([]string, 0, len(poolState.servicePorts))
+	for service := range poolState.servicePorts {
+		if isLoadBalancerPorts(service) == loadBalancer {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		for _, port := range poolState.servicePorts[service] {
+			listener := port.Listener()
+			if owner, ok := used[listener.normalized()]; ok {
+				fmt.Printf("Ignoring listener %s from service %s in pool %s, it conflicts with pool %s\n", listener, service, name, owner)
+				continue
+			}
+			addresses, backupAddresses := d.withFallback(state, name, &port)
+			pools.init(name, port, addresses, backupAddresses, poolState.preferredZone)
+			used[listener.normalized()] = name
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPortAddresses(t *testing.T) {
+	state := newClusterState()
+	state.pools["workers"] = newPoolState("")
+	state.pools["workers"].nodes["node-1"] = nodeState{addresses: []string{"10.0.0.1", "fd00::1"}, zone: "a"}
+	state.pools["workers"].nodes["node-2"] = nodeState{addresses: []string{"10.0.0.2"}, zone: "b"}
+	state.pools["workers"].nodes["node-3"] = nodeState{addresses: []string{"10.0.0.3"}, zone: "b"}
+	state.endpointSlices["default/ingress-abc"] = endpointSliceState{service: "default/ingress", nodes: []string{"node-2"}}
+	state.endpointSlices["default/ingress-def"] = endpointSliceState{service: "default/ingress", nodes: []string{"node-3", "node-4"}}
+	state.endpointSlices["default/web-abc"] = endpointSliceState{service: "default/web", nodes: []string{"node-1"}}
+	cases := []struct {
+		name string
+		port PortMapping
+		want map[string]string
+	}{
+		{
+			name: "all nodes",
+			port: PortMapping{Source: 80, Dest: 30080, Protocol: corev1.ProtocolTCP},
+			want: map[string]string{"10.0.0.1": "a", "fd00::1": "a", "10.0.0.2": "b", "10.0.0.3": "b"},
+		},
+		{
+			name: "nodes with endpoints from all slices",
+			port: PortMapping{Source: 443, Dest: 30443, Protocol: corev1.ProtocolTCP, LocalService: "default/ingress"},
+			want: map[string]string{"10.0.0.2": "b", "10.0.0.3": "b"},
+		},
+		{
+			name: "service without endpoints",
+			port: PortMapping{Source: 8080, Dest: 30081, Protocol: corev1.ProtocolTCP, LocalService: "default/api"},
+			want: map[string]string{},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := state.portAddresses("workers", c.port); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	nodes := func(addresses ...string) *poolState {
+		pool := newPoolState("")
+		for _, address := range addresses {
+			pool.nodes["node-"+address] = nodeState{addresses: []string{address}}
+		}
+		return pool
+	}
+	local := PortMapping{Source: 443, Dest: 30443, Protocol: corev1.ProtocolTCP, LocalService: "default/ingress"}
+	cases := []struct {
+		name        string
+		pools       []NodePoolDescription
+		state       map[string]*poolState
+		slices      map[string]endpointSliceState
+		pool        string
+		port        *PortMapping
+		wantPrimary map[string]string
+		wantBackup  map[string]string
+	}{
+		{
+			name:        "no fallbacks",
+			pools:       []NodePoolDescription{{name: "workers"}},
+			state:       map[string]*poolState{"workers": nodes("10.0.0.1")},
+			pool:        "workers",
+			wantPrimary: map[string]string{"10.0.0.1": ""},
+		},
+		{
+			name:        "pool has nodes",
+			pools:       []NodePoolDescription{{name: "workers", fallbackPools: []string{"cp"}}, {name: "cp"}},
+			state:       map[string]*poolState{"workers": nodes("10.0.0.1"), "cp": nodes("10.0.1.1")},
+			pool:        "workers",
+			wantPrimary: map[string]string{"10.0.0.1": ""},
+		},
+		{
+			name:        "first fallback with nodes",
+			pools:       []NodePoolDescription{{name: "workers", fallbackPools: []string{"infra", "cp"}}, {name: "infra"}, {name: "cp"}},
+			state:       map[string]*poolState{"workers": nodes(), "infra": nodes(), "cp": nodes("10.0.1.1")},
+			pool:        "workers",
+			wantPrimary: map[string]string{"10.0.1.1": ""},
+		},
+		{
+			name:        "no pool has nodes",
+			pools:       []NodePoolDescription{{name: "workers", fallbackPools: []string{"cp"}}, {name: "cp"}},
+			state:       map[string]*poolState{"workers": nodes(), "cp": nodes()},
+			pool:        "workers",
+			wantPrimary: map[string]string{},
+		},
+		{
+			name:        "fallbacks as backups",
+			pools:       []NodePoolDescription{{name: "workers", fallbackPools: []string{"infra", "cp"}, fallbackAsBackup: true}, {name: "infra"}, {name: "cp"}},
+			state:       map[string]*poolState{"workers": nodes("10.0.0.1"), "infra": nodes("10.0.2.1"), "cp": nodes("10.0.1.1")},
+			pool:        "workers",
+			wantPrimary: map[string]string{"10.0.0.1": ""},
+			wantBackup:  map[string]string{"10.0.1.1": "", "10.0.2.1": ""},
+		},
+		{
+			name:        "port without local service",
+			pools:       []NodePoolDescription{{name: "workers", fallbackPools: []string{"cp"}}, {name: "cp"}},
+			state:       map[string]*poolState{"workers": nodes(), "cp": nodes("10.0.1.1")},
+			pool:        "workers",
+			port:        &PortMapping{Source: 80, Dest: 30080, Protocol: corev1.ProtocolTCP},
+			wantPrimary: map[string]string{"10.0.1.1": ""},
+		},
+		{
+			name:        "local service with endpoints in the pool",
+			pools:       []NodePoolDescription{{name: "workers", fallbackPools: []string{"cp"}}, {name: "cp"}},
+			state:       map[string]*poolState{"workers": nodes("10.0.0.1", "10.0.0.2"), "cp": nodes("10.0.1.1")},
+			slices:      map[string]endpointSliceState{"default/ingress-abc": {service: "default/ingress", nodes: []string{"node-10.0.0.2"}}},
+			pool:        "workers",
+			port:        &local,
+			wantPrimary: map[string]string{"10.0.0.2": ""},
+		},
+		{
+			name:        "local service skips fallbacks without endpoints",
+			pools:       []NodePoolDescription{{name: "workers", fallbackPools: []string{"infra", "cp"}}, {name: "infra"}, {name: "cp"}},
+			state:       map[string]*poolState{"workers": nodes("10.0.0.1"), "infra": nodes("10.0.2.1"), "cp": nodes("10.0.1.1", "10.0.1.2")},
+			slices:      map[string]endpointSliceState{"default/ingress-abc": {service: "default/ingress", nodes: []string{"node-10.0.1.2"}}},
+			pool:        "workers",
+			port:        &local,
+			wantPrimary: map[string]string{"10.0.1.2": ""},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := Doorman{nodePools: c.pools}
+			state := newClusterState()
+			state.pools = c.state
+			if c.slices != nil {
+				state.endpointSlices = c.slices
+			}
+			primary, backup := d.withFallback(state, c.pool, c.port)
+			if !reflect.DeepEqual(primary, c.wantPrimary) {
+				t.Errorf("Got addresses %v, want %v", primary, c.wantPrimary)
+			}
+			if !reflect.DeepEqual(backup, c.wantBackup) {
+				t.Errorf("Got backup addresses %v, want %v", backup, c.wantBackup)
+			}
+		})
+	}
+}
+
+func TestCopyLoadBalancerPorts(t *testing.T) {
+	nodePorts := []PortMapping{{Source: 80, Dest: 30080, Protocol: corev1.ProtocolTCP}}
+	live := newClusterState()
+	live.pools["workers"] = newPoolState("")
+	live.pools["workers"].servicePorts[loadBalancerPortsPrefix+"default/web"] = []PortMapping{{Source: 443, Dest: 30443, Address: "10.0.0.10", Protocol: corev1.ProtocolTCP}}
+	live.pools["workers"].servicePorts["default/web"] = nodePorts
+	relisted := newClusterState()
+	relisted.pools["workers"] = newPoolState("")
+	relisted.pools["workers"].servicePorts["default/api"] = nodePorts
+	relisted.pools["workers"].servicePorts[loadBalancerPortsPrefix+"default/old"] = []PortMapping{{Source: 8080, Dest: 30081, Address: "10.0.0.10", Protocol: corev1.ProtocolTCP}}
+	relisted.copyLoadBalancerPorts(live)
+
+	// The listed NodePorts are kept, and the assigned ports are replaced with the live ones
+	want := map[string][]PortMapping{
+		"default/api":                           nodePorts,
+		loadBalancerPortsPrefix + "default/web": live.pools["workers"].servicePorts[loadBalancerPortsPrefix+"default/web"],
+	}
+	if got := relisted.pools["workers"].servicePorts; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// savedState is the state which was last applied, which is saved so that it can be rendered on startup, before the Kubernetes API can be reached
+type savedState struct {
+	// Members are the names of the members of each pool
+	Members map[string][]string `json:"members"`
+	Vars    TemplateVars        `json:"vars"`
+	// Generation and RenderedAt are those of the last generation, so that they continue after a restart
+	Generation int64     `json:"generation"`
+	RenderedAt time.Time `json:"renderedAt"`
+}
+
+// saveState writes the state which was applied to a file, if it has changed
+func saveState(path string, members map[string]map[string]struct{}, vars TemplateVars, meta MetaVars) error {
+	state := savedState{Members: make(map[string][]string, len(members)), Vars: vars, Generation: meta.Generation, RenderedAt: meta.RenderedAt}
+	for pool, poolMembers := range members {
+		names := make([]string, 0, len(poolMembers))
+		for member := range poolMembers {
+			names = append(names, member)
+		}
+		sort.Strings(names)
+		state.Members[pool] = names
+	}
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	_, err = writeFileIfChanged(path, data, 0600)
+	return err
+}
+
+// loadState reads the state which was last applied, returning nil if the file does not exist
+func loadState(path string) (*savedState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Invalid state file %s: %v", path, err)
+	}
+	return &state, nil
+}
+
+// members returns the members of each pool
+func (s *savedState) members() map[string]map[string]struct{} {
+	members := make(map[string]map[string]struct{}, len(s.Members))
+	for pool, names := range s.Members {
+		members[pool] = make(map[string]struct{}, len(names))
+		for _, name := range names {
+			members[pool][name] = struct{}{}
+		}
+	}
+	return members
+}
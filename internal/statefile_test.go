@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doorman-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "doorman.json")
+
+	saved, err := loadState(path)
+	if err != nil || saved != nil {
+		t.Fatalf("Got %v, %v for a missing state file, want nothing", saved, err)
+	}
+
+	poolMembers := map[string]map[string]struct{}{"workers": {"node-2": {}, "node-1": {}}, "cp": {}}
+	vars := TemplateVars{
+		TCPPorts: []PortVars{{Name: "tcp_80", Pool: "workers", Protocol: "tcp", SourcePort: 80, SourcePortEnd: 80, DestPort: 30080, DestPortEnd: 30080, Addresses: []string{"10.0.0.1", "10.0.0.2"}, PortOptions: PortOptions{ConnectTimeout: time.Second}}},
+		UDPPorts: []PortVars{},
+	}
+	meta := MetaVars{Generation: 3, RenderedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := saveState(path, poolMembers, vars, meta); err != nil {
+		t.Fatal(err)
+	}
+	saved, err = loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.Vars, vars) {
+		t.Errorf("Got vars %+v, want %+v", saved.Vars, vars)
+	}
+	if want := map[string][]string{"workers": {"node-1", "node-2"}, "cp": {}}; !reflect.DeepEqual(saved.Members, want) {
+		t.Errorf("Got members %v, want %v", saved.Members, want)
+	}
+	if !reflect.DeepEqual(saved.members(), poolMembers) {
+		t.Errorf("Got members %v, want %v", saved.members(), poolMembers)
+	}
+	if saved.Generation != meta.Generation || !saved.RenderedAt.Equal(meta.RenderedAt) {
+		t.Errorf("Got generation %d rendered at %v, want %d at %v", saved.Generation, saved.RenderedAt, meta.Generation, meta.RenderedAt)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(path); err == nil {
+		t.Error("Expected an error for an invalid state file")
+	}
+}
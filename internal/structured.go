@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+func init() {
+	TemplateFactories["json"] = &StructuredFactory{marshal: marshalJSON}
+	TemplateFactories["yaml"] = &StructuredFactory{marshal: yaml.Marshal}
+}
+
+func marshalJSON(value interface{}) ([]byte, error) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// StructuredTemplater writes the template variables as structured data, or only the values matched by a JSONPath expression
+type StructuredTemplater struct {
+	path    string
+	filter  *jsonpath.JSONPath
+	marshal func(interface{}) ([]byte, error)
+}
+
+func (s *StructuredTemplater) Path() string {
+	return s.path
+}
+
+func (s *StructuredTemplater) Render(ctx context.Context, path string, vars interface{}) ([]byte, error) {
+	// Convert to plain JSON values first, so that the filter uses the same field names as the output
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value = convertNumbers(value)
+	if s.filter != nil {
+		results, err := s.filter.FindResults(value)
+		if err != nil {
+			return nil, err
+		}
+		matches := make([]interface{}, 0)
+		for _, result := range results {
+			for _, match := range result {
+				matches = append(matches, match.Interface())
+			}
+		}
+		value = matches
+	}
+	return s.marshal(value)
+}
+
+// convertNumbers replaces JSON numbers with integers where possible, and floats otherwise, so that they can be compared with the numbers in JSONPath expressions
+func convertNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = convertNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = convertNumbers(item)
+		}
+	}
+	return value
+}
+
+// StructuredFactory parses an optional JSONPath expression, such as {.tcp[*].addresses[*]}, as the template. The braces may be omitted.
+type StructuredFactory struct {
+	marshal func(interface{}) ([]byte, error)
+}
+
+func (s *StructuredFactory) Parse(template string, partials map[string]string, path string) (Templater, error) {
+	if len(partials) != 0 {
+		return nil, fmt.Errorf("Partials can only be used with gotpl templates")
+	}
+	tpl := StructuredTemplater{path: path, marshal: s.marshal}
+	expression := strings.TrimSpace(template)
+	if expression == "" {
+		return &tpl, nil
+	}
+	if !strings.HasPrefix(expression, "{") {
+		expression = "{" + expression + "}"
+	}
+	tpl.filter = jsonpath.New(path).AllowMissingKeys(true)
+	if err := tpl.filter.Parse(expression); err != nil {
+		return nil, fmt.Errorf("Invalid JSONPath expression: %v", err)
+	}
+	return &tpl, nil
+}
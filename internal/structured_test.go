@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStructuredTemplater(t *testing.T) {
+	vars := map[string]interface{}{
+		"tcp": []map[string]interface{}{
+			{"name": "tcp_80", "srcPort": 80, "addresses": []string{"10.0.0.1", "10.0.0.2"}},
+			{"name": "tcp_443", "srcPort": 443, "addresses": []string{"10.0.0.3"}},
+		},
+	}
+	cases := []struct {
+		name     string
+		engine   string
+		template string
+		partials map[string]string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:   "json",
+			engine: "json",
+			want:   "{\n  \"tcp\": [\n    {\n      \"addresses\": [\n        \"10.0.0.1\",\n        \"10.0.0.2\"\n      ],\n      \"name\": \"tcp_80\",\n      \"srcPort\": 80\n    },\n    {\n      \"addresses\": [\n        \"10.0.0.3\"\n      ],\n      \"name\": \"tcp_443\",\n      \"srcPort\": 443\n    }\n  ]\n}\n",
+		},
+		{
+			name:     "json filter",
+			engine:   "json",
+			template: "{.tcp[*].addresses[*]}",
+			want:     "[\n  \"10.0.0.1\",\n  \"10.0.0.2\",\n  \"10.0.0.3\"\n]\n",
+		},
+		{
+			name:     "yaml filter without braces",
+			engine:   "yaml",
+			template: ".tcp[*].name",
+			want:     "- tcp_80\n- tcp_443\n",
+		},
+		{
+			name:     "filter comparing a number",
+			engine:   "yaml",
+			template: "{.tcp[?(@.srcPort==443)].addresses}",
+			want:     "- - 10.0.0.3\n",
+		},
+		{
+			name:     "filter matching nothing",
+			engine:   "json",
+			template: "{.udp[*]}",
+			want:     "[]\n",
+		},
+		{
+			name:     "invalid expression",
+			engine:   "json",
+			template: "{.tcp[}",
+			wantErr:  true,
+		},
+		{
+			name:     "partials",
+			engine:   "yaml",
+			partials: map[string]string{"a": "b"},
+			wantErr:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			templater, err := TemplateFactories[c.engine].Parse(c.template, c.partials, "/tmp/doorman.json")
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := templater.Render(context.Background(), "/tmp/doorman.json", vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != c.want {
+				t.Errorf("Got %q, want %q", data, c.want)
+			}
+		})
+	}
+}
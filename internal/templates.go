@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	gotpl "text/template"
+	"time"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+// TemplateCheckInterval is how often template files and partials are checked for changes
+const TemplateCheckInterval = 2 * time.Second
+
+// DefaultRenderTimeout is how long rendering a file may take if its template does not set a timeout
+const DefaultRenderTimeout = 30 * time.Second
+
+// ManagedFile is a file which is rendered from a template
+type ManagedFile struct {
+	templater   Templater
+	driftPolicy public.DriftPolicy
+	timeout     time.Duration
+	options     fileOptions
+
+	factory      TemplateFactory
+	path         string
+	template     string
+	templateFile string
+	partials     []string
+	// preset is the preset the template is, if any
+	preset *TemplatePreset
+	// params are the parameters of the preset, if the template is one
+	params map[string]string
+	// vars are the top-level and template vars
+	vars map[string]string
+	// env are the allowed environment variables
+	env map[string]string
+	// forEach is what a file is rendered for each of, if not a single file
+	forEach public.ForEach
+	// pathTemplate renders the path of each file, if forEach is set
+	pathTemplate *gotpl.Template
+	// pathGlob matches any path pathTemplate can render, if forEach is set
+	pathGlob string
+	// fingerprint is the hash of the template and partials which were last loaded
+	fingerprint string
+	// parseErr is the error from parsing them, if any
+	parseErr error
+	// problem is the last reported problem with loading them, if any
+	problem string
+}
+
+func (m *ManagedFile) FromConfig(cfg *public.Template) error {
+	factory, ok := TemplateFactories[cfg.Engine]
+	if !ok {
+		return fmt.Errorf("Unrecognized template engine: %s", cfg.Engine)
+	}
+	switch cfg.DriftPolicy {
+	case "":
+		m.driftPolicy = public.DriftPolicyOverwrite
+	case public.DriftPolicyOverwrite, public.DriftPolicyRefuse, public.DriftPolicySaveAside:
+		m.driftPolicy = cfg.DriftPolicy
+	default:
+		return fmt.Errorf("Unrecognized drift policy: %s", cfg.DriftPolicy)
+	}
+	sources := 0
+	for _, source := range []string{cfg.Template, cfg.TemplateFile, cfg.Preset} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("Only one of template, templateFile, and preset may be set for %s", cfg.Path)
+	}
+	m.path = cfg.Path
+	m.template = cfg.Template
+	if cfg.Preset != "" {
+		if factory != TemplateFactories["gotpl"] {
+			return fmt.Errorf("Template presets can only use the gotpl engine")
+		}
+		preset, ok := TemplatePresets[cfg.Preset]
+		if !ok {
+			return fmt.Errorf("Unrecognized template preset: %s", cfg.Preset)
+		}
+		template, err := preset.Template()
+		if err != nil {
+			return err
+		}
+		m.template = template
+		m.preset = &preset
+		if m.path == "" {
+			m.path = preset.Path
+		}
+		if m.params, err = preset.params(cfg.Parameters); err != nil {
+			return err
+		}
+	} else if len(cfg.Parameters) != 0 {
+		return fmt.Errorf("Parameters can only be set for a preset")
+	}
+	if m.path == "" {
+		return fmt.Errorf("A path is required")
+	}
+	switch cfg.ForEach {
+	case "":
+	case public.ForEachPool, public.ForEachPort:
+		m.forEach = cfg.ForEach
+		pathTemplate, err := gotpl.New("path").Funcs(TemplateFuncs).Parse(m.path)
+		if err != nil {
+			return fmt.Errorf("Invalid path %s: %v", m.path, err)
+		}
+		m.pathTemplate = pathTemplate
+		m.pathGlob = pathGlob(m.path)
+		if err := m.checkPathTemplate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unrecognized forEach: %s", cfg.ForEach)
+	}
+	for _, pattern := range cfg.Partials {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid partials pattern %q: %v", pattern, err)
+		}
+	}
+	m.timeout = DefaultRenderTimeout
+	if cfg.Timeout != nil {
+		if cfg.Timeout.Duration <= 0 {
+			return fmt.Errorf("Timeout must be positive, got %v", cfg.Timeout.Duration)
+		}
+		m.timeout = cfg.Timeout.Duration
+	}
+	if err := m.options.FromConfig(cfg); err != nil {
+		return err
+	}
+	m.factory = factory
+	m.templateFile = cfg.TemplateFile
+	m.partials = cfg.Partials
+	_, err := m.load()
+	return err
+}
+
+// watchesFiles returns true if the template is read from any files which may change
+func (m *ManagedFile) watchesFiles() bool {
+	return m.templateFile != "" || len(m.partials) != 0
+}
+
+// load reads and parses the template and its partials, if they changed since they were last loaded, returning true if they were parsed.
+// If they cannot be parsed, the previous template is kept, and they are not parsed again until they change again.
+func (m *ManagedFile) load() (bool, error) {
+	hash := sha256.New()
+	template := m.template
+	if m.templateFile != "" {
+		data, err := ioutil.ReadFile(m.templateFile)
+		if err != nil {
+			return false, err
+		}
+		template = string(data)
+	}
+	fmt.Fprintf(hash, "%s\x00%s\x00", m.templateFile, template)
+	// Partials are named by their file name, like with text/template's ParseGlob
+	partials := make(map[string]string)
+	// partialPaths are the paths each partial was read from, as two files with the same name would otherwise silently replace each other
+	partialPaths := make(map[string]string)
+	for _, pattern := range m.partials {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return false, err
+		}
+		for _, match := range matches {
+			name := filepath.Base(match)
+			if other, ok := partialPaths[name]; ok {
+				if other == match {
+					continue
+				}
+				return false, fmt.Errorf("Partials %s and %s have the same name %s", other, match, name)
+			}
+			partialPaths[name] = match
+			data, err := ioutil.ReadFile(match)
+			if err != nil {
+				return false, err
+			}
+			partials[name] = string(data)
+			fmt.Fprintf(hash, "%s\x00%s\x00", match, data)
+		}
+	}
+	fingerprint := hex.EncodeToString(hash.Sum(nil))
+	if fingerprint == m.fingerprint {
+		return false, m.parseErr
+	}
+	m.fingerprint = fingerprint
+	tpl, err := m.factory.Parse(template, partials, m.path)
+	m.parseErr = err
+	if err != nil {
+		return false, err
+	}
+	m.templater = tpl
+	return true, nil
+}
+
+// reloadTemplates loads any templates whose files changed, returning true if any were parsed
+func (d *Doorman) reloadTemplates() bool {
+	reloaded := false
+	var problems []string
+	for i := range d.templates {
+		file := &d.templates[i]
+		if !file.watchesFiles() {
+			continue
+		}
+		loaded, err := file.load()
+		if err != nil {
+			problem := fmt.Sprintf("Template for %s could not be loaded: %v", file.path, err)
+			if problem != file.problem {
+				fmt.Printf("%s, using the previous template\n", problem)
+			}
+			file.problem = problem
+			problems = append(problems, problem)
+			continue
+		}
+		file.problem = ""
+		if loaded {
+			fmt.Printf("Reloaded template for %s\n", file.path)
+			reloaded = true
+		}
+	}
+	if d.health != nil {
+		d.health.SetProblems("templates", problems)
+	}
+	return reloaded
+}
+
+// RenderVars are the variables a template is rendered with
+type RenderVars struct {
+	TemplateVars
+	// Params are the parameters of the preset, if the template is one
+	Params map[string]string `json:"params,omitempty"`
+	// Vars are the user-defined variables from the config file
+	Vars map[string]string `json:"vars"`
+	// Env are the allowed environment variables, which are empty if not set
+	Env map[string]string `json:"env"`
+	// Meta describes the render, e.g. for a header
+	Meta MetaVars `json:"meta"`
+}
+
+// renderVars returns the variables to render the template with
+func (m *ManagedFile) renderVars(templateVars TemplateVars, meta MetaVars) RenderVars {
+	return RenderVars{TemplateVars: templateVars, Params: m.params, Vars: m.vars, Env: m.env, Meta: meta}
+}
+
+// mergeVars returns the top-level vars, overridden by those of a template
+func mergeVars(global, template map[string]string) map[string]string {
+	vars := make(map[string]string, len(global)+len(template))
+	for name, value := range global {
+		vars[name] = value
+	}
+	for name, value := range template {
+		vars[name] = value
+	}
+	return vars
+}
+
+// allowedEnv returns the values of the allowed environment variables, with those which are not set being empty
+func allowedEnv(names []string) (map[string]string, error) {
+	env := make(map[string]string, len(names))
+	for _, name := range names {
+		if name == "" || strings.Contains(name, "=") {
+			return nil, fmt.Errorf("Invalid environment variable name %q", name)
+		}
+		env[name] = os.Getenv(name)
+	}
+	return env, nil
+}
+
+// pathActions matches the actions of a path template
+var pathActions = regexp.MustCompile(`\{\{.*?\}\}`)
+
+// pathGlob returns a glob pattern which matches any path a path template can render, by replacing each action with a wildcard
+func pathGlob(path string) string {
+	literals := pathActions.Split(path, -1)
+	for i, literal := range literals {
+		literals[i] = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(literal)
+	}
+	return strings.Join(literals, "*")
+}
+
+// checkPathTemplate checks that the path template renders a different path for each pool or port, by rendering it for pools or ports which differ in only one field.
+// Otherwise, which pools or ports collide would only be found once they exist.
+func (m *ManagedFile) checkPathTemplate() error {
+	var samples []interface{}
+	var fields string
+	switch m.forEach {
+	case public.ForEachPool:
+		samples = []interface{}{struct{ Pool string }{Pool: "workers"}, struct{ Pool string }{Pool: "control-plane"}}
+		fields = ".Pool"
+	case public.ForEachPort:
+		port := func(name, protocol, listenAddress string, sourcePort int) PortVars {
+			return PortVars{Name: name, Pool: "workers", Protocol: protocol, ListenAddress: listenAddress, SourcePort: sourcePort, SourcePortEnd: sourcePort, DestPort: 30080, DestPortEnd: 30080, Addresses: []string{"10.0.0.1"}}
+		}
+		samples = []interface{}{
+			port("tcp_80", "tcp", "", 80),
+			port("udp_80", "udp", "", 80),
+			port("tcp_10_0_0_10_80", "tcp", "10.0.0.10", 80),
+			port("tcp_443", "tcp", "", 443),
+		}
+		fields = ".Name, or each of .Protocol, .ListenAddress, and .SourcePort"
+	}
+	seen := make(map[string]struct{}, len(samples))
+	for _, sample := range samples {
+		var path bytes.Buffer
+		if err := m.pathTemplate.Execute(&path, sample); err != nil {
+			return fmt.Errorf("Rendering path %s failed: %v", m.path, err)
+		}
+		if _, ok := seen[path.String()]; ok {
+			return fmt.Errorf("Path %s can render %s for more than one %s, it must use %s", m.path, path.String(), strings.ToLower(string(m.forEach)), fields)
+		}
+		seen[path.String()] = struct{}{}
+	}
+	return nil
+}
+
+// renderedFile is a single file to render from a template
+type renderedFile struct {
+	path string
+	vars RenderVars
+}
+
+// forPorts returns template variables with only some of the ports, and only the hosts of a pool, if one is given
+func (t TemplateVars) forPorts(tcpPorts, udpPorts []PortVars, pool string) TemplateVars {
+	hosts := make([]HostVars, 0)
+	if pool != "" {
+		for _, host := range t.HTTPHosts {
+			if host.Pool == pool {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return TemplateVars{TCPPorts: tcpPorts, UDPPorts: udpPorts, HTTPHosts: hosts, TLSSecrets: t.TLSSecrets}
+}
+
+// files returns each file to render, and the variables to render it with
+func (m *ManagedFile) files(templateVars TemplateVars, meta MetaVars) ([]renderedFile, error) {
+	if m.forEach == "" {
+		return []renderedFile{{path: m.path, vars: m.renderVars(templateVars, meta)}}, nil
+	}
+	type item struct {
+		pathVars interface{}
+		vars     TemplateVars
+	}
+	items := make([]item, 0)
+	switch m.forEach {
+	case public.ForEachPool:
+		tcpPorts := make(map[string][]PortVars)
+		udpPorts := make(map[string][]PortVars)
+		for _, port := range templateVars.TCPPorts {
+			tcpPorts[port.Pool] = append(tcpPorts[port.Pool], port)
+		}
+		for _, port := range templateVars.UDPPorts {
+			udpPorts[port.Pool] = append(udpPorts[port.Pool], port)
+		}
+		// A pool may only have Ingress hosts, e.g. one whose ports are all HTTP
+		seenPools := make(map[string]struct{})
+		pools := make([]string, 0, len(tcpPorts)+len(udpPorts))
+		addPool := func(pool string) {
+			if _, ok := seenPools[pool]; !ok {
+				seenPools[pool] = struct{}{}
+				pools = append(pools, pool)
+			}
+		}
+		for pool := range tcpPorts {
+			addPool(pool)
+		}
+		for pool := range udpPorts {
+			addPool(pool)
+		}
+		for _, host := range templateVars.HTTPHosts {
+			addPool(host.Pool)
+		}
+		sort.Strings(pools)
+		for _, pool := range pools {
+			items = append(items, item{
+				pathVars: struct{ Pool string }{Pool: pool},
+				vars:     templateVars.forPorts(tcpPorts[pool], udpPorts[pool], pool),
+			})
+		}
+	case public.ForEachPort:
+		for _, port := range templateVars.TCPPorts {
+			items = append(items, item{pathVars: port, vars: templateVars.forPorts([]PortVars{port}, nil, "")})
+		}
+		for _, port := range templateVars.UDPPorts {
+			items = append(items, item{pathVars: port, vars: templateVars.forPorts(nil, []PortVars{port}, "")})
+		}
+	}
+	files := make([]renderedFile, 0, len(items))
+	seen := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		var path bytes.Buffer
+		if err := m.pathTemplate.Execute(&path, item.pathVars); err != nil {
+			return nil, fmt.Errorf("Rendering path %s failed: %v", m.path, err)
+		}
+		if _, ok := seen[path.String()]; ok {
+			return nil, fmt.Errorf("Path %s renders %s more than once", m.path, path.String())
+		}
+		seen[path.String()] = struct{}{}
+		files = append(files, renderedFile{path: path.String(), vars: m.renderVars(item.vars, meta)})
+	}
+	return files, nil
+}
@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestManagedFileFromConfig(t *testing.T) {
+	cases := []struct {
+		name        string
+		cfg         public.Template
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{name: "default timeout", cfg: public.Template{Path: "/tmp/a", Template: "a"}, wantTimeout: DefaultRenderTimeout},
+		{name: "timeout", cfg: public.Template{Path: "/tmp/a", Template: "a", Timeout: &metav1.Duration{Duration: time.Second}}, wantTimeout: time.Second},
+		{name: "zero timeout", cfg: public.Template{Path: "/tmp/a", Template: "a", Timeout: &metav1.Duration{}}, wantErr: true},
+		{name: "negative timeout", cfg: public.Template{Path: "/tmp/a", Template: "a", Timeout: &metav1.Duration{Duration: -time.Second}}, wantErr: true},
+		{name: "unrecognized engine", cfg: public.Template{Path: "/tmp/a", Template: "a", Engine: "jinja"}, wantErr: true},
+		{name: "unrecognized drift policy", cfg: public.Template{Path: "/tmp/a", Template: "a", DriftPolicy: "Ignore"}, wantErr: true},
+		{name: "template and template file", cfg: public.Template{Path: "/tmp/a", Template: "a", TemplateFile: "/tmp/a.tpl"}, wantErr: true},
+		{name: "missing template file", cfg: public.Template{Path: "/tmp/a", TemplateFile: "/nonexistent/a.tpl"}, wantErr: true},
+		{name: "invalid partials pattern", cfg: public.Template{Path: "/tmp/a", Template: "a", Partials: []string{"/tmp/["}}, wantErr: true},
+		{name: "invalid path template", cfg: public.Template{Path: "/tmp/{{ .Pool", Template: "a", ForEach: public.ForEachPool}, wantErr: true},
+		{name: "unrecognized forEach", cfg: public.Template{Path: "/tmp/{{ .Pool }}", Template: "a", ForEach: "Host"}, wantErr: true},
+		{name: "each pool", cfg: public.Template{Path: "/tmp/{{ .Pool }}.conf", Template: "a", ForEach: public.ForEachPool}, wantTimeout: DefaultRenderTimeout},
+		{name: "each pool without the pool", cfg: public.Template{Path: "/tmp/pool.conf", Template: "a", ForEach: public.ForEachPool}, wantErr: true},
+		{name: "each port", cfg: public.Template{Path: "/tmp/{{ .Pool }}-{{ .Protocol }}-{{ .ListenAddress }}-{{ .SourcePort }}.conf", Template: "a", ForEach: public.ForEachPort}, wantTimeout: DefaultRenderTimeout},
+		{name: "each port without the protocol", cfg: public.Template{Path: "/tmp/{{ .Pool }}-{{ .ListenAddress }}-{{ .SourcePort }}.conf", Template: "a", ForEach: public.ForEachPort}, wantErr: true},
+		{name: "each port without the listen address", cfg: public.Template{Path: "/tmp/{{ .Pool }}-{{ .Protocol }}-{{ .SourcePort }}.conf", Template: "a", ForEach: public.ForEachPort}, wantErr: true},
+		{name: "path fails to render", cfg: public.Template{Path: "/tmp/{{ atoi .Pool }}.conf", Template: "a", ForEach: public.ForEachPool}, wantErr: true},
+		{name: "preset", cfg: public.Template{Preset: "nginx", Parameters: map[string]string{"workerProcesses": "4"}}, wantTimeout: DefaultRenderTimeout},
+		{name: "template and preset", cfg: public.Template{Path: "/tmp/a", Template: "a", Preset: "nginx"}, wantErr: true},
+		{name: "preset with another engine", cfg: public.Template{Preset: "nginx", Engine: "json"}, wantErr: true},
+		{name: "unrecognized preset", cfg: public.Template{Preset: "caddy"}, wantErr: true},
+		{name: "unrecognized preset parameter", cfg: public.Template{Preset: "nginx", Parameters: map[string]string{"workers": "4"}}, wantErr: true},
+		{name: "parameters without a preset", cfg: public.Template{Path: "/tmp/a", Template: "a", Parameters: map[string]string{"a": "b"}}, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var m ManagedFile
+			err := m.FromConfig(&c.cfg)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.timeout != c.wantTimeout {
+				t.Errorf("Got timeout %v, want %v", m.timeout, c.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestManagedFilePartials(t *testing.T) {
+	dir := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dir, "doorman.conf.tpl"), `{{ template "greeting" . }} {{ template "name.tpl" . }}`)
+	write(filepath.Join(dir, "partials", "greeting.tpl"), `{{ define "greeting" }}hello{{ end }}`)
+	write(filepath.Join(dir, "partials", "name.tpl"), `world`)
+
+	var m ManagedFile
+	cfg := public.Template{
+		Path:         filepath.Join(dir, "doorman.conf"),
+		TemplateFile: filepath.Join(dir, "doorman.conf.tpl"),
+		// The same file matching more than one pattern is not a duplicate
+		Partials: []string{filepath.Join(dir, "partials", "*.tpl"), filepath.Join(dir, "partials", "name.tpl")},
+	}
+	if err := m.FromConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	out, err := m.templater.Render(context.Background(), cfg.Path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello world" {
+		t.Errorf("Got %q, want hello world", out)
+	}
+	if parsed, err := m.load(); parsed || err != nil {
+		t.Errorf("Got %v, %v from loading unchanged files", parsed, err)
+	}
+
+	// Another file with the same name as a partial is rejected, and the previous template is kept
+	write(filepath.Join(dir, "more", "name.tpl"), `again`)
+	m.partials = append(m.partials, filepath.Join(dir, "more", "*.tpl"))
+	if _, err := m.load(); err == nil {
+		t.Error("Expected an error for partials with the same name")
+	}
+	if out, err := m.templater.Render(context.Background(), cfg.Path, nil); err != nil || string(out) != "hello world" {
+		t.Errorf("Got %q, %v after a failed load, want hello world", out, err)
+	}
+	cfg.Partials = m.partials
+	if err := new(ManagedFile).FromConfig(&cfg); err == nil {
+		t.Error("Expected an error for partials with the same name")
+	}
+}
+
+func TestPathGlob(t *testing.T) {
+	cases := []struct {
+		path string
+		want string
+	}{
+		{path: "/etc/nginx/nginx.conf", want: "/etc/nginx/nginx.conf"},
+		{path: "/etc/nginx/stream.d/{{ .Pool }}.conf", want: "/etc/nginx/stream.d/*.conf"},
+		{path: "/etc/nginx/stream.d/{{ .Pool }}-{{ .Protocol }}-{{ .SourcePort }}.conf", want: "/etc/nginx/stream.d/*-*-*.conf"},
+		{path: "/etc/{{ .Pool }}/{{ if .IsRange }}range{{ end }}.conf", want: "/etc/*/*range*.conf"},
+		{path: "/etc/lb[1]/*?{{ .Pool }}", want: `/etc/lb\[1]/\*\?*`},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			if got := pathGlob(c.path); got != c.want {
+				t.Errorf("Got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestManagedFileFiles(t *testing.T) {
+	templateVars := TemplateVars{
+		TCPPorts: []PortVars{
+			{Name: "tcp_80", Pool: "workers", Protocol: "tcp", SourcePort: 80, SourcePortEnd: 80},
+			{Name: "tcp_6443", Pool: "cp", Protocol: "tcp", SourcePort: 6443, SourcePortEnd: 6443},
+		},
+		UDPPorts: []PortVars{
+			{Name: "udp_80", Pool: "workers", Protocol: "udp", SourcePort: 80, SourcePortEnd: 80},
+		},
+		// A pool with only hosts still has a file of its own
+		HTTPHosts: []HostVars{{Host: "a.example.com", Pool: "workers"}, {Host: "b.example.com", Pool: "ingress"}},
+	}
+	type file struct {
+		path      string
+		tcpPorts  []string
+		udpPorts  []string
+		httpHosts []string
+	}
+	cases := []struct {
+		name    string
+		path    string
+		forEach public.ForEach
+		want    []file
+	}{
+		{
+			name: "single file",
+			path: "/tmp/doorman.conf",
+			want: []file{{path: "/tmp/doorman.conf", tcpPorts: []string{"tcp_80", "tcp_6443"}, udpPorts: []string{"udp_80"}, httpHosts: []string{"a.example.com", "b.example.com"}}},
+		},
+		{
+			name:    "each pool",
+			path:    "/tmp/{{ .Pool }}.conf",
+			forEach: public.ForEachPool,
+			want: []file{
+				{path: "/tmp/cp.conf", tcpPorts: []string{"tcp_6443"}, udpPorts: []string{}, httpHosts: []string{}},
+				{path: "/tmp/ingress.conf", tcpPorts: []string{}, udpPorts: []string{}, httpHosts: []string{"b.example.com"}},
+				{path: "/tmp/workers.conf", tcpPorts: []string{"tcp_80"}, udpPorts: []string{"udp_80"}, httpHosts: []string{"a.example.com"}},
+			},
+		},
+		{
+			name:    "each port",
+			path:    "/tmp/{{ .Name }}.conf",
+			forEach: public.ForEachPort,
+			want: []file{
+				{path: "/tmp/tcp_80.conf", tcpPorts: []string{"tcp_80"}, udpPorts: []string{}, httpHosts: []string{}},
+				{path: "/tmp/tcp_6443.conf", tcpPorts: []string{"tcp_6443"}, udpPorts: []string{}, httpHosts: []string{}},
+				{path: "/tmp/udp_80.conf", tcpPorts: []string{}, udpPorts: []string{"udp_80"}, httpHosts: []string{}},
+			},
+		},
+	}
+	names := func(ports []PortVars) []string {
+		names := make([]string, 0, len(ports))
+		for _, port := range ports {
+			names = append(names, port.Name)
+		}
+		return names
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var m ManagedFile
+			if err := m.FromConfig(&public.Template{Path: c.path, Template: "a", ForEach: c.forEach}); err != nil {
+				t.Fatal(err)
+			}
+			rendered, err := m.files(templateVars, MetaVars{Generation: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]file, 0, len(rendered))
+			for _, r := range rendered {
+				hosts := make([]string, 0, len(r.vars.HTTPHosts))
+				for _, host := range r.vars.HTTPHosts {
+					hosts = append(hosts, host.Host)
+				}
+				got = append(got, file{path: r.path, tcpPorts: names(r.vars.TCPPorts), udpPorts: names(r.vars.UDPPorts), httpHosts: hosts})
+				if r.vars.Meta.Generation != 1 {
+					t.Errorf("File %s was not given the metadata", r.path)
+				}
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMergeVars(t *testing.T) {
+	got := mergeVars(map[string]string{"resolver": "10.1.0.53", "workers": "auto"}, map[string]string{"workers": "4"})
+	want := map[string]string{"resolver": "10.1.0.53", "workers": "4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	if got := mergeVars(nil, nil); got == nil || len(got) != 0 {
+		t.Errorf("Got %v, want an empty map", got)
+	}
+}
+
+func TestAllowedEnv(t *testing.T) {
+	os.Setenv("DOORMAN_TEST_SITE", "dc1")
+	defer os.Unsetenv("DOORMAN_TEST_SITE")
+	got, err := allowedEnv([]string{"DOORMAN_TEST_SITE", "DOORMAN_TEST_UNSET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"DOORMAN_TEST_SITE": "dc1", "DOORMAN_TEST_UNSET": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	for _, name := range []string{"", "A=B"} {
+		if _, err := allowedEnv([]string{name}); err == nil {
+			t.Errorf("Expected an error for %q", name)
+		}
+	}
+}
+
+func TestRenderVars(t *testing.T) {
+	var m ManagedFile
+	if err := m.FromConfig(&public.Template{Path: "/tmp/a", Template: `{{ .Vars.resolver }} {{ .Env.SITE }} {{ len .TCPPorts }}`}); err != nil {
+		t.Fatal(err)
+	}
+	m.vars = map[string]string{"resolver": "10.1.0.53"}
+	m.env = map[string]string{"SITE": "dc1"}
+	templateVars := TemplateVars{TCPPorts: []PortVars{{Name: "tcp_80"}}}
+	out, err := m.templater.Render(context.Background(), m.path, m.renderVars(templateVars, MetaVars{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "10.1.0.53 dc1 1" {
+		t.Errorf("Got %q", out)
+	}
+}
@@ -1,24 +1,48 @@
 package doorman
 
 import (
+	"encoding/json"
 	"fmt"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"strings"
 )
 
 // ConfigFile contains the structure parsed from the YAML config file
 type ConfigFile struct {
 	Kubernetes *KubernetesConfigFile `json:"kubernetes"`
-	NodePools  []NodePoolConfigFile  `json:"nodePools"`
-	Templates  []Template            `json:"templates"`
-	Health     *HealthConfigFile     `json:"health"`
-	Metrics    *MetricsConfigFile    `json:"metrics"`
+	// NodePools, if absent, are the pools of the NodePoolsPreset
+	NodePools []NodePoolConfigFile `json:"nodePools"`
+	// NodePoolsPreset is the name of the built-in pools to use if NodePools is absent, defaults to pools which cover the role labels of common distributions
+	NodePoolsPreset string `json:"nodePoolsPreset"`
+	// EndpointPools are pools whose members are the endpoints of a Service instead of nodes
+	EndpointPools []EndpointPoolConfigFile `json:"endpointPools"`
+	// Templates, if absent, are the built-in nginx template written to /etc/nginx/nginx.conf
+	Templates []Template         `json:"templates"`
+	Health    *HealthConfigFile  `json:"health"`
+	Metrics   *MetricsConfigFile `json:"metrics"`
+	// LoadBalancer, if present, makes doorman the load balancer for Services of type LoadBalancer
+	LoadBalancer *LoadBalancerConfigFile `json:"loadBalancer"`
+	// Ingresses, if present, adds the hosts and paths of Ingresses to the template variables for HTTP routing
+	Ingresses *IngressesConfigFile `json:"ingresses"`
+	// TLSSecrets are kubernetes.io/tls Secrets to write to disk, e.g. to terminate TLS on the load balancer
+	TLSSecrets []TLSSecretConfigFile `json:"tlsSecrets"`
+	// StateFile, if present, is where the last applied state is saved, so that it can be rendered on startup if the Kubernetes API cannot be reached
+	StateFile string `json:"stateFile"`
+	// ResyncInterval, if present, is how often to list everything again and render all templates from scratch, logging anything which drifted
+	ResyncInterval *metav1.Duration `json:"resyncInterval"`
+	// Vars are given to every template as .Vars, e.g. for values which differ between sites
+	Vars map[string]string `json:"vars"`
+	// Env are the names of environment variables which are given to every template as .Env
+	Env []string `json:"env"`
 	// TODO: Add ability to configure the post-template action(s)
 }
 
-// HealthConfigFile is the health endpoint section of the config file
+// HealthConfigFile is the health endpoint section of the config file. The endpoint is served at /healthz on this port.
 type HealthConfigFile struct {
-	Port int `json:"health"`
+	Port int `json:"port"`
 }
 
 // MetricsConfigFile is the metrics section of the config file
@@ -32,10 +56,122 @@ type KubernetesConfigFile struct {
 	Contexts        []string `json:"contexts"`
 }
 
-// PortMapping is a mapping from a port on one host to a port on another. If dest is absent, the source is assumed to be the dest.
+// PortMapping is a mapping from a port on one host to a port on another. If dest is absent, the source is assumed to be the dest. If listenAddress is absent, the source port is listened on for all addresses.
+// The source may be a range of ports, in which case each port in the range is mapped to the port offset from it by offset, and dest may not be used.
 type PortMapping struct {
-	Source int  `json:"src"`
-	Dest   *int `json:"dest"`
+	Source        PortRange `json:"src"`
+	Dest          *int      `json:"dest"`
+	Offset        int       `json:"offset"`
+	ListenAddress string    `json:"listenAddress"`
+	// LocalService, if present, only sends traffic to nodes which have a ready endpoint of this Service, as is required for Services with externalTrafficPolicy: Local.
+	// Ports discovered from such Services do this automatically.
+	LocalService *ServiceReference `json:"localService"`
+	PortOptions  `json:",inline"`
+}
+
+// ServiceReference identifies a Service. If namespace is absent, the default namespace is assumed.
+type ServiceReference struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// Key returns the namespace/name of the Service
+func (s *ServiceReference) Key() string {
+	namespace := s.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	return fmt.Sprintf("%s/%s", namespace, s.Name)
+}
+
+// PortRange is an inclusive range of ports. It is parsed from either a single port number, or a string of the form "first-last"
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// IsRange returns true if the range contains more than one port
+func (p PortRange) IsRange() bool {
+	return p.First != p.Last
+}
+
+func (p PortRange) String() string {
+	if !p.IsRange() {
+		return strconv.Itoa(p.First)
+	}
+	return fmt.Sprintf("%d-%d", p.First, p.Last)
+}
+
+// ParsePortRange parses either a single port number, or a string of the form "first-last"
+func ParsePortRange(str string) (PortRange, error) {
+	var p PortRange
+	var err error
+	parts := strings.SplitN(str, "-", 2)
+	p.First, err = strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return p, fmt.Errorf("Invalid port range %q: %v", str, err)
+	}
+	p.Last = p.First
+	if len(parts) == 2 {
+		p.Last, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return p, fmt.Errorf("Invalid port range %q: %v", str, err)
+		}
+	}
+	return p, p.Validate()
+}
+
+// Validate checks that both ends of the range are valid ports, and that the range is not backwards
+func (p PortRange) Validate() error {
+	if p.First < 1 || p.Last > 65535 {
+		return fmt.Errorf("Port range %s is outside of 1-65535", p)
+	}
+	if p.First > p.Last {
+		return fmt.Errorf("Port range %s ends before it starts", p)
+	}
+	return nil
+}
+
+func (p *PortRange) UnmarshalJSON(data []byte) error {
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		p.First = port
+		p.Last = port
+		return p.Validate()
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("Port range must be a port number or a string of the form first-last, got %s", string(data))
+	}
+	parsed, err := ParsePortRange(str)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+func (p PortRange) MarshalJSON() ([]byte, error) {
+	if !p.IsRange() {
+		return json.Marshal(p.First)
+	}
+	return json.Marshal(p.String())
+}
+
+// PortOptions are optional load balancing settings for a single port mapping. They are not interpreted by doorman, only passed through to templates, so templates are responsible for choosing defaults when they are absent.
+type PortOptions struct {
+	// Algorithm is the load balancing method. The presets accept roundRobin, leastConn, random, and sourceHash, while other templates receive it as-is
+	Algorithm string `json:"algorithm"`
+	// ConnectTimeout is the time allowed to establish a connection to a backend
+	ConnectTimeout *metav1.Duration `json:"connectTimeout"`
+	// IdleTimeout is the time allowed between successive reads or writes before a connection is closed
+	IdleTimeout *metav1.Duration `json:"idleTimeout"`
+	// MaxFails is the number of failed attempts before a backend is considered unavailable
+	MaxFails *int `json:"maxFails"`
+	// ProxyProtocol enables the PROXY protocol when connecting to backends
+	ProxyProtocol bool `json:"proxyProtocol"`
+	// Options are arbitrary additional settings for use by templates
+	Options map[string]string `json:"options"`
 }
 
 // NodePoolConfigFile is the node pool section of the config field. For a node to be part of the pool, it must match one or more of the elements of the selector array.
@@ -45,7 +181,122 @@ type NodePoolConfigFile struct {
 	UDPPorts      []PortMapping          `json:"udpPorts"`
 	NodeSelectors []Selector             `json:"nodeSelectors"`
 	AddressType   corev1.NodeAddressType `json:"addressType"`
-	// TODO: Add ability to specify nodeport range(s) to map to these nodes
+	// NodePortServices, if present, discovers additional ports to load balance to these nodes from the NodePorts of Services
+	NodePortServices *NodePortServicesConfigFile `json:"nodePortServices"`
+	// PreferredZone, if present, sends traffic only to nodes in this zone (from the topology.kubernetes.io/zone label), with nodes in other zones as backups.
+	// If there are no nodes in this zone, traffic is sent to all nodes.
+	PreferredZone string `json:"preferredZone"`
+	// FallbackPools are the names of other node pools to send traffic to when this pool has no nodes, using the first which has any
+	FallbackPools []string `json:"fallbackPools"`
+	// FallbackAsBackup, if true, also provides the nodes of the fallback pools to templates as backups while this pool has nodes
+	FallbackAsBackup bool `json:"fallbackAsBackup"`
+	// Guard, if present, prevents templates from being rendered when too many nodes would be removed from this pool at once
+	Guard *GuardConfigFile `json:"guard"`
+}
+
+// GuardConfigFile limits the changes to a pool's membership which are rendered. When a limit is exceeded, the last rendered files are kept,
+// and the health endpoint reports the problem, until the membership is within the limits again, the membership does not change for the
+// stabilization period, or an operator overrides it by sending SIGUSR1 to doorman.
+type GuardConfigFile struct {
+	// MinMembers is the fewest members the pool may have
+	MinMembers int `json:"minMembers"`
+	// MaxRemovedFraction is the largest fraction (0-1) of the rendered members which may be removed within the removal window. If absent or zero, any number may be removed
+	MaxRemovedFraction float64 `json:"maxRemovedFraction"`
+	// RemovalWindow is the period over which removed members are counted, 1m if absent. Nodes usually leave one at a time, even when many leave at once,
+	// so removals are counted against the members which were rendered at the start of the window.
+	RemovalWindow *metav1.Duration `json:"removalWindow"`
+	// StabilizationPeriod, if present, is how long the membership must not change before it is rendered despite exceeding a limit.
+	// If absent, an operator override is required.
+	StabilizationPeriod *metav1.Duration `json:"stabilizationPeriod"`
+}
+
+// ListenPortsAnnotation may be set on a Service to choose the port listened on for its NodePorts.
+// It is a comma-separated list of name=port, where name is the name or number of a port of the Service.
+// Ports which are not listed are listened on using the Service port.
+const ListenPortsAnnotation = "doorman.meln5674.github.com/listen-ports"
+
+// NodePortServicesConfigFile selects the Services whose NodePorts are load balanced to the nodes of a pool
+type NodePortServicesConfigFile struct {
+	// Namespace to watch Services in, all namespaces if absent
+	Namespace string `json:"namespace"`
+	// Labels selects which Services to use, all Services with NodePorts if absent
+	Labels *metav1.LabelSelector `json:"labels"`
+	// ListenAddress is the address to listen on for discovered ports, all addresses if absent
+	ListenAddress string `json:"listenAddress"`
+	// PortOptions are used for every discovered port
+	PortOptions `json:",inline"`
+}
+
+// LoadBalancerConfigFile is the load balancer section of the config file. Each matching Service of type LoadBalancer is assigned one of the addresses,
+// which is listened on using the Service's ports, forwarding to its NodePorts on the nodes of a node pool. The address is then written to the Service's status.
+type LoadBalancerConfigFile struct {
+	// NodePool is the name of the node pool to forward traffic to
+	NodePool string `json:"nodePool"`
+	// Addresses are the addresses (e.g. VIPs) which may be assigned to Services. A Service may request one of these using spec.loadBalancerIP
+	Addresses []string `json:"addresses"`
+	// Ports, if present, limits the ports which may be listened on
+	Ports []PortRange `json:"ports"`
+	// LoadBalancerClass is the value of spec.loadBalancerClass of the Services to handle. If absent, only Services without a class are handled
+	LoadBalancerClass string `json:"loadBalancerClass"`
+	// Namespace to watch Services in, all namespaces if absent
+	Namespace string `json:"namespace"`
+	// Labels selects which Services to handle, all Services of type LoadBalancer if absent
+	Labels *metav1.LabelSelector `json:"labels"`
+	// PortOptions are used for every port of every Service
+	PortOptions `json:",inline"`
+}
+
+// IngressPoolAnnotation may be set on an Ingress to choose the pool its hosts are routed to, instead of the default pool
+const IngressPoolAnnotation = "doorman.meln5674.github.com/pool"
+
+// IngressesConfigFile is the ingresses section of the config file. The hosts, paths, and TLS secrets of each matching Ingress are added to the template variables,
+// with the pool its traffic should be routed to, e.g. the nodes running an ingress controller
+type IngressesConfigFile struct {
+	// Pool is the name of the node or endpoint pool to route hosts to, unless an Ingress has the pool annotation
+	Pool string `json:"pool"`
+	// IngressClassName is the class of the Ingresses to use, from spec.ingressClassName or the kubernetes.io/ingress.class annotation. All Ingresses are used if absent
+	IngressClassName string `json:"ingressClassName"`
+	// Namespace to watch Ingresses in, all namespaces if absent
+	Namespace string `json:"namespace"`
+	// Labels selects which Ingresses to use, all Ingresses if absent
+	Labels *metav1.LabelSelector `json:"labels"`
+}
+
+// TLSSecretConfigFile selects kubernetes.io/tls Secrets whose certificate and key are written to disk. The key is only readable by its owner.
+type TLSSecretConfigFile struct {
+	// Namespace to watch Secrets in, all namespaces if absent
+	Namespace string `json:"namespace"`
+	// Name, if present, selects a single Secret, which is written to CertPath and KeyPath
+	Name     string `json:"name"`
+	CertPath string `json:"certPath"`
+	KeyPath  string `json:"keyPath"`
+	// Labels, if present, selects Secrets by label instead of by name, which are written to Directory as <namespace>/<name>.crt and <namespace>/<name>.key
+	Labels    *metav1.LabelSelector `json:"labels"`
+	Directory string                `json:"directory"`
+}
+
+// EndpointPoolConfigFile is the endpoint pool section of the config file. The members of the pool are the ready endpoints (e.g. pod IPs) of a Service,
+// taken from its EndpointSlices, and traffic is forwarded directly to them instead of through NodePorts
+type EndpointPoolConfigFile struct {
+	Name     string                `json:"name"`
+	Service  ServiceReference      `json:"service"`
+	TCPPorts []EndpointPortMapping `json:"tcpPorts"`
+	UDPPorts []EndpointPortMapping `json:"udpPorts"`
+	// AddressType, if present, only uses endpoints with this type of address (IPv4, IPv6, or FQDN)
+	AddressType discoveryv1.AddressType `json:"addressType"`
+	// PreferredZone is the same as for node pools, using the zones of the endpoints
+	PreferredZone string `json:"preferredZone"`
+	// Guard is the same as for node pools, using the endpoints as members
+	Guard *GuardConfigFile `json:"guard"`
+}
+
+// EndpointPortMapping is a mapping from a port on one host to a port of the endpoints of a Service. The endpoint port is identified by the name of the Service port it is for,
+// which may be absent if the Service has a single unnamed port. If listenAddress is absent, the source port is listened on for all addresses.
+type EndpointPortMapping struct {
+	Source        int    `json:"src"`
+	PortName      string `json:"portName"`
+	ListenAddress string `json:"listenAddress"`
+	PortOptions   `json:",inline"`
 }
 
 // FieldSelector describes a kubernetes field selector
@@ -83,9 +334,62 @@ type Selector struct {
 	Fields *[]FieldSelector      `json:"fields"`
 }
 
+// DriftPolicy is what to do when a rendered file was edited since it was last rendered
+type DriftPolicy string
+
+const (
+	// DriftPolicyOverwrite overwrites the edited file, and logs a warning
+	DriftPolicyOverwrite DriftPolicy = "Overwrite"
+	// DriftPolicyRefuse leaves the edited file in place, and reports the problem on the health endpoint
+	DriftPolicyRefuse DriftPolicy = "Refuse"
+	// DriftPolicySaveAside copies the edited file next to it before overwriting it
+	DriftPolicySaveAside DriftPolicy = "SaveAside"
+)
+
+// ForEach is what a template renders a file for each of
+type ForEach string
+
+const (
+	// ForEachPool renders a file for each pool with any ports or Ingress hosts
+	ForEachPool ForEach = "Pool"
+	// ForEachPort renders a file for each TCP and UDP port, or range of ports
+	ForEachPort ForEach = "Port"
+)
+
 // Template contains the configuration for templating a file with node information
 type Template struct {
 	Template string `json:"template"`
-	Path     string `json:"path"`
-	Engine   string `json:"engine"`
+	// TemplateFile is a file to read the template from instead
+	TemplateFile string `json:"templateFile"`
+	// Preset is the name of a built-in template to use instead. Only one of template, templateFile, and preset may be set
+	Preset string `json:"preset"`
+	// Parameters override the default parameters of the preset
+	Parameters map[string]string `json:"parameters"`
+	// Partials are glob patterns of files which are parsed along with the template, so that the templates they define can be used from it
+	Partials []string `json:"partials"`
+	// Path is where the file is written, which may be omitted for a preset to use its default path.
+	// If ForEach is set, it is a gotpl template which is rendered for each file.
+	Path   string `json:"path"`
+	Engine string `json:"engine"`
+	// ForEach, if set, renders a file for each pool or port, instead of a single file
+	ForEach ForEach `json:"forEach"`
+	// DriftPolicy is what to do if the file was edited since it was last rendered, defaults to Overwrite
+	DriftPolicy DriftPolicy `json:"driftPolicy"`
+	// Timeout is how long rendering the file may take, defaults to 30s
+	Timeout *metav1.Duration `json:"timeout"`
+	// Owner is the user name or ID which owns the file. If not set, a replaced file keeps its owner
+	Owner string `json:"owner"`
+	// Group is the group name or ID which owns the file. If not set, a replaced file keeps its group
+	Group string `json:"group"`
+	// Mode is the octal permissions of the file, e.g. "0640". If not set, a replaced file keeps its permissions, and a new file is 0644
+	Mode string `json:"mode"`
+	// CreateDirs creates the directory of the file, and its parents, if they do not exist
+	CreateDirs bool `json:"createDirs"`
+	// DirMode is the octal permissions of created directories, defaults to "0755"
+	DirMode string `json:"dirMode"`
+	// SELinuxContext is the SELinux context of the file, e.g. system_u:object_r:httpd_config_t:s0.
+	// If not set, a replaced file keeps its context
+	SELinuxContext string `json:"seLinuxContext"`
+	// Vars are given to the template as .Vars, along with the top-level vars, which they override
+	Vars map[string]string `json:"vars"`
 }
@@ -0,0 +1,53 @@
+package doorman_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	public "github.com/meln5674/doorman/pkg/doorman"
+)
+
+func TestPortRangeJSON(t *testing.T) {
+	cases := []struct {
+		json    string
+		want    public.PortRange
+		wantErr bool
+	}{
+		{json: `80`, want: public.PortRange{First: 80, Last: 80}},
+		{json: `"80"`, want: public.PortRange{First: 80, Last: 80}},
+		{json: `"30000-30010"`, want: public.PortRange{First: 30000, Last: 30010}},
+		{json: `"30000 - 30010"`, want: public.PortRange{First: 30000, Last: 30010}},
+		{json: `0`, wantErr: true},
+		{json: `"80-70000"`, wantErr: true},
+		{json: `"81-80"`, wantErr: true},
+		{json: `"80-"`, wantErr: true},
+		{json: `"http"`, wantErr: true},
+		{json: `[80]`, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.json, func(t *testing.T) {
+			var got public.PortRange
+			err := json.Unmarshal([]byte(c.json), &got)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("Got %v, want %v", got, c.want)
+			}
+			data, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var roundTrip public.PortRange
+			if err := json.Unmarshal(data, &roundTrip); err != nil || roundTrip != got {
+				t.Errorf("Marshaled %v as %s, which does not round trip", got, data)
+			}
+		})
+	}
+}